@@ -1,21 +1,27 @@
 package main
 
 import (
-	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	"log"
+	"maps"
 	"math/big"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"regexp"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 
 	"golang.org/x/net/html"
 	"golang.org/x/net/html/atom"
@@ -27,45 +33,305 @@ import (
 )
 
 type Component struct {
-	Name string
-	Path string
+	Name      string
+	Path      string
+	Ambiguous []string // Every file a discovered name matched when there's more than one
 }
 
-// Render renders the template with the given data
-func RecursiveRender(path string, props map[string]any, scopeStack []scopeStackItem) (string, string, string, []scopeStackItem, string) {
-	// Split template into parts
-	markup, fence, script, style := templateParts(path)
-	// Get list of imported components and remove imports from fence
-	fence, components := getComponents(path, fence)
+// Config holds the options that apply to every template
+type Config struct {
+	// TrimWhitespace drops the indentation and line break around control tags
+	// that sit on their own line, like a component with "use trim"; in its fence
+	TrimWhitespace bool
+	// ComponentDirs are scanned for components that can be used without an import,
+	// named in PascalCase after their file (e.g. age_button.html becomes AgeButton)
+	ComponentDirs []string
+	// MaxRecursion is how many times a component can render inside itself,
+	// like a tree that renders its branches, before it's an error (100 when 0)
+	MaxRecursion int
+	// DynamicRoot is the directory <='{path}' /> components are resolved against
+	// and can't leave, which is the working directory when it's empty
+	DynamicRoot string
+	// DynamicAllow limits dynamic components to the paths in DynamicRoot that
+	// match one of its globs (e.g. "views/cards/*.html") when it isn't empty
+	DynamicAllow []string
+}
+
+// renderState is shared by every template rendered for one call to Render
+type renderState struct {
+	config Config     // A copy, so changing the caller's config can't change a render that's running
+	slots  []slotFill // Every <slot> rendered so far, the ID in a slot's placeholder is its index
+	// The components found in config.ComponentDirs, nil until the first template asks for them
+	discovered []Component
+	// The scoped styles and scripts of every template rendered so far, in the order they're bundled
+	scopeStack []scopeStackItem
+}
+
+// renderFrame is what a template hands down to its markup and the components it renders
+type renderFrame struct {
+	components    []Component    // Imported by the template or discovered in config.ComponentDirs
+	chain         []string       // The templates that led here, starting with the page and ending with this one
+	contextValues map[string]any // Everything the templates in the chain set with setContext
+	state         *renderState
+}
+
+// slotFill is what a component's <slot> hands to the content the parent fills it with
+type slotFill struct {
+	name  string
+	props map[string]any
+}
+
+// Diagnostic is a template error that points at the file, line and column it came from
+type Diagnostic struct {
+	Path        string
+	Line        int // 0 when the error isn't tied to a spot in the file
+	Column      int
+	Message     string
+	Snippet     string   // Code frame around the line the error is on
+	ImportChain []string // Components that led to Path, starting with the page
+}
+
+func (d *Diagnostic) Error() string {
+	var b strings.Builder
+	b.WriteString(d.Path)
+	if d.Line > 0 {
+		fmt.Fprintf(&b, ":%d:%d", d.Line, d.Column)
+	}
+	b.WriteString(": " + d.Message)
+	for i := len(d.ImportChain) - 1; i >= 0; i-- {
+		b.WriteString("\n\timported by " + d.ImportChain[i])
+	}
+	if d.Snippet != "" {
+		b.WriteString("\n" + d.Snippet)
+	}
+	return b.String()
+}
+
+// markupError is an error at an index of a template's markup,
+// RecursiveRender turns it into a Diagnostic once it's back at the file it came from
+type markupError struct {
+	index   int    // -1 until the control node it happened in is known
+	expr    string // The {} expression that failed, used to find the exact spot
+	message string
+}
+
+func (e *markupError) Error() string {
+	return e.message
+}
+
+// fenceError is a JS error at a line and column of a template's fence
+type fenceError struct {
+	line    int
+	column  int
+	message string
+}
+
+func (e *fenceError) Error() string {
+	return e.message
+}
+
+// RecursiveRender renders the template with the given data, caller is the frame of the template using it
+// and only has the render's state for a page
+func RecursiveRender(path string, props map[string]any, caller *renderFrame) (string, string, string, string, error) {
+	chain, contextValues, state := caller.chain, caller.contextValues, caller.state
+	// Split template into parts and parse them, unless it's cached from an earlier render
+	tmpl, err := compileTemplate(path, state.config.TrimWhitespace)
+	if err != nil {
+		return "", "", "", "", diagnose(tmpl.layout, path, chain, err)
+	}
+	layout := tmpl.layout
+	// Keep the props as they were passed so they can be spread with {...$props}
+	passedProps := make(map[string]any, len(props))
+	for k, v := range props {
+		if k != "$props" && k != "$context" {
+			passedProps[k] = v
+		}
+	}
+	props["$props"] = passedProps
+	// Add the discovered components to the imported ones
+	components, err := templateComponents(tmpl.imports, state)
+	if err != nil {
+		return "", "", "", "", diagnose(layout, path, chain, err)
+	}
+	// Props passed with the wrong type are the fault of the template passing them, so a component
+	// leaves the error for the parent to place at its tag, a page points at the prop's declaration
+	err = checkRequiredProps(path, tmpl.required, props)
+	if err == nil {
+		err = checkPropTypes(path, tmpl.propTypes, props)
+	}
+	if err != nil {
+		if len(chain) > 0 {
+			return "", "", "", "", err
+		}
+		return "", "", "", "", diagnose(layout, path, chain, err)
+	}
 	// Set the prop to the value that's passed in
-	fence, fence_logic := setProps(fence, props)
-	// Get list of all variables declared in fence
-	allVars := getAllVars(fence)
+	fence, fence_logic := setProps(tmpl.fence, props)
 	// Run the JS in Goja to get the computed values for props
-	props = evaluateProps(fence, allVars, props)
-	// Build AST with {if} and {for} controls + text nodes
-	controlTree, err := buildControlTree(markup)
+	props, setValues, err := evaluateProps(fence, tmpl.allVars, props, contextValues)
+	if err != nil {
+		return "", "", "", "", diagnose(layout, path, chain, err)
+	}
+	// What this template sets with setContext is seen by everything it renders, and kept
+	// with its props as $context so the client can read the same values when it hydrates
+	if len(setValues) > 0 {
+		contextValues = maps.Clone(contextValues)
+		maps.Copy(contextValues, setValues)
+		props["$context"] = contextValues
+	}
+	frame := &renderFrame{
+		components:    components,
+		chain:         append(append([]string{}, chain...), path), // Components rendered from here were imported by this one
+		contextValues: contextValues,
+		state:         state,
+	}
+	var markup string
+	if tmpl.extends != "" {
+		markup, err = extendLayout(tmpl, props, frame)
+	} else {
+		markup, err = evalControlTree(tmpl.controlTree, props, frame)
+	}
 	if err != nil {
-		fmt.Println(err)
+		return "", "", "", "", diagnose(layout, path, chain, err)
 	}
-	markup, scopeStack = evalControlTree(controlTree, scopeStack, props, components)
 
-	return markup, script, style, scopeStack, fence_logic
+	return markup, tmpl.script, tmpl.style, fence_logic, nil
 }
 
-func Render(path string, props map[string]any) (string, string, string, string) {
-	markup, script, style, scopeStack, fence_logic := RecursiveRender(path, props, []scopeStackItem{})
+func Render(path string, props map[string]any, config Config) (string, string, string, string, error) {
+	config.ComponentDirs = slices.Clone(config.ComponentDirs)
+	config.DynamicAllow = slices.Clone(config.DynamicAllow)
+	state := &renderState{config: config}
+	markup, script, style, fence_logic, err := RecursiveRender(path, props, &renderFrame{contextValues: map[string]any{}, state: state})
+	if err != nil {
+		return "", "", "", "", err
+	}
 	// Create scoped classes and add to html
-	markup, scopedElements := scopeHTML(markup, props)
-	scopeStack = append(scopeStack, scopeStackItem{
+	markup, scopedElements, err := scopeHTML(markup, props)
+	if err != nil {
+		tmpl, _ := compileTemplate(path, config.TrimWhitespace)
+		return "", "", "", "", diagnose(tmpl.layout, path, nil, err)
+	}
+	state.scopeStack = append(state.scopeStack, scopeStackItem{
 		scopedElements: scopedElements,
 		style:          style,
 		script:         script,
 	})
 	// Add scoped classes to css
-	style, script = evalScopeStack(scopeStack)
+	style, script = evalScopeStack(state.scopeStack)
+	// A page's own <slot> can't be filled and its {block}s are done being filled, so they keep what they have
+	markup = regexp.MustCompile(`<!--plenti-(?:slot|block):[^>]*-->|<!--/plenti-(?:slot|block)-->`).ReplaceAllString(markup, "")
+	// Put back the braces that were escaped in evaluated values and drop the {@html} markers
+	markup = strings.NewReplacer(escapedOpenBrace, "{", escapedCloseBrace, "}", rawHTMLStart, "", rawHTMLEnd, "", spreadRendered, "").Replace(markup)
+
+	return markup, script, style, fence_logic, nil
+}
+
+// markupErrorf returns a markupError at the given index of the markup
+func markupErrorf(index int, format string, a ...any) error {
+	return &markupError{index: index, message: fmt.Sprintf(format, a...)}
+}
+
+// errorAt places err at an index of the markup, unless it already knows where it happened
+func errorAt(index int, err error) error {
+	var diag *Diagnostic
+	if errors.As(err, &diag) {
+		return err
+	}
+	var mErr *markupError
+	if errors.As(err, &mErr) {
+		if mErr.index == -1 {
+			mErr.index = index
+		}
+		return err
+	}
+	return &markupError{index: index, message: err.Error()}
+}
+
+// newDiagnostic creates a Diagnostic at an offset into the template file
+func newDiagnostic(layout templateLayout, path string, offset int, message string) *Diagnostic {
+	diag := &Diagnostic{Path: path, Message: message}
+	if offset < 0 || offset > len(layout.template) {
+		return diag
+	}
+	template := layout.template
+	lineStart := strings.LastIndex(template[:offset], "\n") + 1
+	diag.Line = strings.Count(template[:offset], "\n") + 1
+	diag.Column = offset - lineStart + 1
+
+	// Show the line with the error and the lines around it, with a caret under the column
+	lines := strings.Split(template, "\n")
+	first := max(diag.Line-2, 1)
+	last := min(diag.Line+1, len(lines))
+	width := len(strconv.Itoa(last))
+	frame := []string{}
+	for n := first; n <= last; n++ {
+		marker := " "
+		if n == diag.Line {
+			marker = ">"
+		}
+		frame = append(frame, fmt.Sprintf("%s %*d | %s", marker, width, n, lines[n-1]))
+		if n == diag.Line {
+			// Keep tabs so the caret lines up with the code above it
+			indent := regexp.MustCompile(`[^\t]`).ReplaceAllString(template[lineStart:offset], " ")
+			frame = append(frame, fmt.Sprintf("  %*s | %s^", width, "", indent))
+		}
+	}
+	diag.Snippet = strings.Join(frame, "\n")
+	return diag
+}
+
+// diagnose turns an error from rendering the template at path into a Diagnostic
+func diagnose(layout templateLayout, path string, chain []string, err error) error {
+	var diag *Diagnostic
+	if errors.As(err, &diag) {
+		if diag.Path == path && diag.ImportChain == nil {
+			diag.ImportChain = chain
+		}
+		return diag
+	}
+	offset := -1
+	var mErr *markupError
+	var fErr *fenceError
+	if errors.As(err, &mErr) {
+		index := mErr.index
+		if mErr.expr != "" {
+			// Point at the expression itself instead of the control node it's in
+			if exprIndex := strings.Index(layout.markup[max(index, 0):], "{"+mErr.expr); exprIndex != -1 {
+				index = max(index, 0) + exprIndex
+			}
+		}
+		if index != -1 {
+			offset = layout.markupOffset(index)
+		}
+	} else if errors.As(err, &fErr) {
+		offset = layout.fenceOffset(fErr.line, fErr.column)
+	}
+	diag = newDiagnostic(layout, path, offset, err.Error())
+	diag.ImportChain = chain
+	return diag
+}
 
-	return markup, script, style, fence_logic
+// jsMessage returns the message of a Goja error without the position Goja adds to it
+func jsMessage(err error) string {
+	var exception *goja.Exception
+	if errors.As(err, &exception) {
+		message := exception.Value().String()
+		return regexp.MustCompile(`SyntaxError: \(anonymous\): Line \d+:\d+ `).ReplaceAllString(message, "")
+	}
+	return err.Error()
+}
+
+// jsPosition returns the line and column of the JS a Goja error happened at, or 0, 0 when it doesn't say
+func jsPosition(err error) (int, int) {
+	rePosition := regexp.MustCompile(`(?:<eval>:|Line )(\d+):(\d+)`)
+	match := rePosition.FindStringSubmatch(err.Error())
+	if match == nil {
+		return 0, 0
+	}
+	line, _ := strconv.Atoi(match[1])
+	column, _ := strconv.Atoi(match[2])
+	return line, column
 }
 
 func evalScopeStack(scopeStack []scopeStackItem) (string, string) {
@@ -163,24 +429,27 @@ type scopedElement struct {
 	scopedClass string
 }
 
-func scopeHTML(markup string, props map[string]any) (string, []scopedElement) {
+func scopeHTML(markup string, props map[string]any) (string, []scopedElement, error) {
 	scopedElements := []scopedElement{}
 	node, _ := html.Parse(strings.NewReader(markup))
 
-	node, scopedElements = traverse(node, scopedElements, props)
+	node, scopedElements, err := traverse(node, scopedElements, props)
+	if err != nil {
+		return "", scopedElements, err
+	}
 
 	// Render the modified HTML back to a string
 	buf := &strings.Builder{}
-	err := html.Render(buf, node)
+	err = html.Render(buf, node)
 	if err != nil {
-		log.Fatal(err)
+		return "", scopedElements, err
 	}
-	markup = html.UnescapeString(buf.String())
+	markup = buf.String()
 
-	return markup, scopedElements
+	return markup, scopedElements, nil
 }
 
-func scopeHTMLComp(comp_markup string, evaled_props map[string]any, comp_props map[string]any, fence_logic string) (string, []scopedElement) {
+func scopeHTMLComp(comp_markup string, evaled_props map[string]any, comp_props map[string]any, fence_logic string, events map[string]string, emitsEvents bool) (string, []scopedElement, error) {
 	// We scope components differently than the full document
 	// because html.Parse() builds a full document tree, aka wraps the component in <html><body></body></html>.
 	// This shakes out when getting applied to the existing document tree, but we've scope styles for the html and body elements
@@ -197,13 +466,22 @@ func scopeHTMLComp(comp_markup string, evaled_props map[string]any, comp_props m
 		DataAtom: atom.Body,
 	})
 	for _, node := range nodes {
-		node, scopedElements = traverse(node, scopedElements, evaled_props)
+		var err error
+		node, scopedElements, err = traverse(node, scopedElements, evaled_props)
+		if err != nil {
+			return "", scopedElements, err
+		}
 
+		// The context the component set is kept on its root for getContext in the components inside it
+		context_str := ""
+		if contextValues, ok := evaled_props["$context"]; ok && node.Type == html.ElementNode {
+			context_str = "_context: " + makeAttrStr(anyToString(contextValues)) + ", "
+		}
 		if len(comp_props) > 0 {
 			x_data_str, x_init_str := makeGetter(comp_props, fence_logic)
 			attr := html.Attribute{
 				Key: "x-data",
-				Val: x_data_str,
+				Val: "{" + context_str + x_data_str[1:],
 			}
 			node.Attr = append(node.Attr, attr)
 			attr = html.Attribute{
@@ -211,44 +489,67 @@ func scopeHTMLComp(comp_markup string, evaled_props map[string]any, comp_props m
 				Val: x_init_str,
 			}
 			node.Attr = append(node.Attr, attr)
+		} else if context_str != "" {
+			node.Attr = append(node.Attr, html.Attribute{
+				Key: "x-data",
+				Val: "{" + context_str + "}",
+			})
+		}
+		if node.Type == html.ElementNode && emitsEvents {
+			// Marks where the component's events come from, so handlers on a component outside it can skip them
+			node.Attr = append(node.Attr, html.Attribute{Key: "data-plenti-events"})
+		}
+		if node.Type == html.ElementNode {
+			// The events the component $dispatch-es bubble up to its root elements
+			for _, event := range sortedKeys(events) {
+				node.Attr = append(node.Attr, html.Attribute{
+					Key: "x-on:" + event,
+					Val: makeEventHandler(events[event]),
+				})
+			}
 		}
 
 		buf := &strings.Builder{}
-		err := html.Render(buf, node)
+		err = html.Render(buf, node)
 		if err != nil {
-			log.Fatal(err)
+			return "", scopedElements, err
 		}
-		fragments = append(fragments, html.UnescapeString(buf.String()))
+		fragments = append(fragments, buf.String())
 	}
 	comp_markup = ""
 	for _, f := range fragments {
 		comp_markup = comp_markup + f
 	}
 
-	return comp_markup, scopedElements
+	return comp_markup, scopedElements, nil
 }
 
-func traverse(node *html.Node, scopedElements []scopedElement, props map[string]any) (*html.Node, []scopedElement) {
+func traverse(node *html.Node, scopedElements []scopedElement, props map[string]any) (*html.Node, []scopedElement, error) {
+	var firstErr error
 	var traverse func(*html.Node)
 	traverse = func(node *html.Node) {
 		if node.Type == html.ElementNode && node.Data == "html" {
-			if len(props) > 0 {
+			// A layout's <html> already has its props, which include the ones passed from the page
+			if len(props) > 0 && !hasAttr(node.Attr, "x-data") {
+				// $props is only for spreading at build time, the client has each prop by name
+				data := make(map[string]any, len(props))
+				for k, v := range props {
+					if k == "$context" {
+						data["_context"] = v
+					} else if k != "$props" {
+						data[k] = v
+					}
+				}
 				attr := html.Attribute{
 					Key: "x-data",
-					Val: makeAttrStr(anyToString(props)),
+					Val: makeAttrStr(anyToString(data)),
 				}
 				node.Attr = append(node.Attr, attr)
 			}
 		}
-		if node.Type == html.TextNode {
-			if strings.Contains(node.Data, "{") && strings.Contains(node.Data, "}") {
-				attr := html.Attribute{
-					Key: "x-text",
-					Val: "`" + strings.ReplaceAll(strings.ReplaceAll(node.Data, "{", "${"), "\"", "'") + "`",
-				}
-				node.Parent.Attr = append(node.Parent.Attr, attr)
-			}
-			node.Data = evalAllBrackets(node.Data, props)
+		err := hydrateBrackets(node, props)
+		if err != nil && firstErr == nil && !inTemplate(node) {
+			firstErr = err
 		}
 		if node.Type == html.ElementNode && node.DataAtom.String() != "" {
 			tag := node.Data
@@ -282,15 +583,6 @@ func traverse(node *html.Node, scopedElements []scopedElement, props map[string]
 						node.Attr[i].Val += " " + scopedClass
 					}
 				}
-				if strings.Contains(attr.Val, "{") && strings.Contains(attr.Val, "}") {
-					if attr.Key != "x-text" && attr.Key != "x-data" && attr.Key != "x-init" && !strings.HasPrefix(attr.Key, ":") {
-						node.Attr = append(node.Attr, html.Attribute{
-							Key: ":" + attr.Key,
-							Val: "`" + strings.ReplaceAll(strings.ReplaceAll(attr.Val, "{", "${"), "\"", "'") + "`",
-						})
-						node.Attr[i].Val = evalAllBrackets(attr.Val, props)
-					}
-				}
 			}
 
 			if len(classes) == 0 {
@@ -304,13 +596,374 @@ func traverse(node *html.Node, scopedElements []scopedElement, props map[string]
 				scopedClass: scopedClass,
 			})
 		}
+		inRawHTML := false
 		for child := node.FirstChild; child != nil; child = child.NextSibling {
-			traverse(child)
+			// Leave {@html} output exactly as it was given
+			if child.Type == html.CommentNode && (child.Data == "@html" || child.Data == "/@html") {
+				inRawHTML = child.Data == "@html"
+				continue
+			}
+			if !inRawHTML {
+				traverse(child)
+			}
 		}
 	}
 	traverse(node)
 
-	return node, scopedElements
+	return node, scopedElements, firstErr
+}
+
+// inTemplate checks if the node is inside a <template>, which Alpine renders
+// in the browser with values that don't exist at build time
+func inTemplate(node *html.Node) bool {
+	for parent := node.Parent; parent != nil; parent = parent.Parent {
+		if parent.Type == html.ElementNode && parent.Data == "template" {
+			return true
+		}
+	}
+	return false
+}
+
+// hydrateBrackets evaluates the {} brackets in a text node or element attributes
+// and adds the matching Alpine bindings so the values stay reactive on the client
+func hydrateBrackets(node *html.Node, props map[string]any) error {
+	if node.Type == html.TextNode {
+		if node.Parent != nil && node.Parent.Data == "style" {
+			// Braces in inline styles belong to CSS
+			return nil
+		}
+		if node.Parent != nil && node.Parent.Data == "script" {
+			if inTemplate(node) {
+				// Alpine clones the script, there's nothing to evaluate it with at build time
+				return nil
+			}
+			// Only rendered at build time, Alpine's x-text wouldn't run the script again
+			evaluated, err := escapeBrackets(node.Data, props, "script")
+			node.Data = evaluated
+			return err
+		}
+		evaluated, xText, err := hydrateText(node.Data, props)
+		if xText != nil && node.Parent != nil && !containsRawHTML(node.Parent) {
+			node.Parent.Attr = append(node.Parent.Attr, *xText)
+		}
+		node.Data = evaluated
+		return err
+	}
+	if node.Type == html.ElementNode {
+		attrs, err := hydrateAttrs(node.Attr, props)
+		node.Attr = attrs
+		return err
+	}
+	return nil
+}
+
+// containsRawHTML checks for {@html} output or a slot or block that an x-text binding on the node would wipe out
+func containsRawHTML(node *html.Node) bool {
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if child.Type == html.CommentNode && (child.Data == "@html" || isPlaceholderComment(child.Data)) {
+			return true
+		}
+	}
+	return false
+}
+
+// isPlaceholderComment checks if the data of a comment is the start of a slot or block placeholder
+func isPlaceholderComment(data string) bool {
+	return strings.HasPrefix("<!--"+data, slotPlaceholderStart) || strings.HasPrefix("<!--"+data, blockPlaceholderStart)
+}
+
+// hydrateText evaluates the brackets in text and returns the x-text binding for its parent element
+func hydrateText(text string, props map[string]any) (string, *html.Attribute, error) {
+	var xText *html.Attribute
+	if strings.Contains(text, "{") && strings.Contains(text, "}") {
+		xText = &html.Attribute{Key: "x-text", Val: clientText(text)}
+	}
+	evaluated, err := escapeBrackets(text, props, "text")
+	return evaluated, xText, err
+}
+
+// clientText turns text with brackets into the template literal Alpine's x-text shows on the client
+func clientText(text string) string {
+	return "`" + strings.ReplaceAll(strings.ReplaceAll(text, "{", "${"), "\"", "'") + "`"
+}
+
+// hydrateAttrs evaluates the brackets in attribute values and adds a matching :attr binding for each
+func hydrateAttrs(attrs []html.Attribute, props map[string]any) ([]html.Attribute, error) {
+	for i, attr := range attrs {
+		if attr.Key == "x-bind" && !strings.HasPrefix(attr.Val, spreadRendered) {
+			// Render the spread attributes now, Alpine keeps them bound in the browser
+			spread, err := spreadAttrs(attrs, attr.Val, props)
+			if err != nil {
+				return attrs, err
+			}
+			attrs = spread
+			attrs[i].Val = spreadRendered + attr.Val
+			continue
+		}
+		if strings.Contains(attr.Val, "{") && strings.Contains(attr.Val, "}") {
+			// Alpine directives already hold JS instead of template text
+			if !strings.HasPrefix(attr.Key, "x-") && !strings.HasPrefix(attr.Key, ":") && !strings.HasPrefix(attr.Key, "@") {
+				context := attrContext(attr.Key)
+				attrs = append(attrs, html.Attribute{
+					Key: ":" + attr.Key,
+					Val: strings.ReplaceAll(clientTemplate(attr.Val, context), "\"", "'"),
+				})
+				evaluated, err := escapeBrackets(attr.Val, props, context)
+				if err != nil {
+					return attrs, err
+				}
+				attrs[i].Val = evaluated
+			}
+		}
+	}
+	return attrs, nil
+}
+
+const (
+	// Evaluated values swap their braces for these so they can't be evaluated again
+	// as template code by a later pass, Render puts the real braces back at the end
+	escapedOpenBrace  = "\uE000"
+	escapedCloseBrace = "\uE001"
+	// {@html} output is wrapped in these comments so later passes leave it alone
+	rawHTMLStart = "<!--@html-->"
+	rawHTMLEnd   = "<!--/@html-->"
+	// Starts the x-bind of a spread that's already been rendered, so later passes don't render it again
+	spreadRendered = "\uE002"
+	// Mark where a component's <slot> goes until the parent fills it in,
+	// the start holds the slot's ID in renderState.slots and the fallback sits in between
+	slotPlaceholderStart = "<!--plenti-slot:"
+	slotPlaceholderEnd   = "<!--/plenti-slot-->"
+	// Mark a layout's {block} until the template extending it fills it in,
+	// the start holds the block's name and the default content sits in between
+	blockPlaceholderStart = "<!--plenti-block:"
+	blockPlaceholderEnd   = "<!--/plenti-block-->"
+	// Marks where the items a {for} with a key or {else} rendered at build time start, removeForItems
+	// clears them out up to here so the loop's x-for can render them instead
+	forItemsStart  = "<!--plenti-for-->"
+	removeForItems = "for (let node = $el.previousSibling; node; node = $el.previousSibling) { node.remove(); if (node.nodeType === Node.COMMENT_NODE && node.data === 'plenti-for') break }"
+)
+
+// spreadAttrs adds the attributes from an object spread onto an element,
+// attributes that are set on the element itself win over the spread ones
+func spreadAttrs(attrs []html.Attribute, expr string, props map[string]any) ([]html.Attribute, error) {
+	value, err := evalJS("("+expr+")", props)
+	if err != nil {
+		return attrs, err
+	}
+	obj, ok := value.(map[string]any)
+	if !ok && value != nil {
+		return attrs, fmt.Errorf("{...%s} can only spread an object, got %T", expr, value)
+	}
+	keys := make([]string, 0, len(obj))
+	for key := range obj {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		value := obj[key]
+		// Handlers aren't spread, a string from data shouldn't become script
+		if value == nil || value == false || reflect.ValueOf(value).Kind() == reflect.Func || isHandlerAttr(key) || hasAttr(attrs, key) {
+			continue
+		}
+		val := ""
+		if value != true {
+			val = escapeValue(value, attrContext(key), "")
+		}
+		attrs = append(attrs, html.Attribute{Key: key, Val: val})
+	}
+	return attrs, nil
+}
+
+func hasAttr(attrs []html.Attribute, key string) bool {
+	for _, attr := range attrs {
+		if attr.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// urlAttrs hold URLs, so their values are checked for unsafe schemes like javascript:
+var urlAttrs = map[string]bool{
+	"href": true, "src": true, "action": true, "formaction": true, "poster": true,
+	"cite": true, "background": true, "xlink:href": true, "ping": true,
+}
+
+// handlerAttrs are the inline event handlers like onclick, which hold script instead of a value
+var handlerAttrs = map[string]bool{}
+
+func init() {
+	for _, event := range strings.Fields(`abort afterprint animationcancel animationend animationiteration animationstart
+		auxclick beforecopy beforecut beforeinput beforematch beforepaste beforeprint beforetoggle beforeunload blur
+		cancel canplay canplaythrough change click close contextlost contextmenu contextrestored copy cuechange cut
+		dblclick drag dragend dragenter dragleave dragover dragstart drop durationchange emptied ended error
+		focus focusin focusout formdata fullscreenchange fullscreenerror gotpointercapture hashchange input invalid
+		keydown keypress keyup languagechange load loadeddata loadedmetadata loadstart lostpointercapture
+		message messageerror mousedown mouseenter mouseleave mousemove mouseout mouseover mouseup mousewheel
+		offline online pagehide pagereveal pageshow pageswap paste pause play playing pointercancel pointerdown
+		pointerenter pointerleave pointermove pointerout pointerover pointerrawupdate pointerup popstate progress
+		ratechange rejectionhandled reset resize scroll scrollend securitypolicyviolation seeked seeking select
+		selectionchange selectstart slotchange stalled storage submit suspend timeupdate toggle touchcancel
+		touchend touchmove touchstart transitioncancel transitionend transitionrun transitionstart
+		unhandledrejection unload volumechange waiting webkitanimationend webkitanimationiteration
+		webkitanimationstart webkittransitionend wheel`) {
+		handlerAttrs["on"+event] = true
+	}
+}
+
+// isHandlerAttr checks for inline event handlers like onclick, an attribute that only starts with "on" is a plain value
+func isHandlerAttr(key string) bool {
+	return handlerAttrs[strings.ToLower(key)]
+}
+
+// attrContext returns how values interpolated into the attribute need to be escaped
+func attrContext(key string) string {
+	if isHandlerAttr(key) {
+		return "script"
+	}
+	if urlAttrs[key] {
+		return "url"
+	}
+	return "attr"
+}
+
+// escapeBrackets evaluates each {} bracket in str like evalAllBrackets does,
+// but escapes the values for the context they're output in so props can't
+// inject markup or script. Raw output needs an explicit {@html} tag instead
+func escapeBrackets(str string, props map[string]any, context string) (string, error) {
+	var out strings.Builder
+	for {
+		startPos := strings.IndexRune(str, '{')
+		if startPos == -1 {
+			break
+		}
+		endPos := strings.IndexRune(str[startPos:], '}')
+		if endPos == -1 {
+			break
+		}
+		endPos += startPos
+		out.WriteString(str[:startPos])
+		jsCode := str[startPos+1 : endPos]
+		value, err := evalJS(jsCode, props)
+		if err != nil {
+			return "", err
+		}
+		out.WriteString(escapeValue(value, context, out.String()))
+		str = str[endPos+1:]
+	}
+	out.WriteString(str)
+	return out.String(), nil
+}
+
+// escapeValue formats a value for the context it's output in,
+// prefix is everything in the attribute before the value
+func escapeValue(value any, context string, prefix string) string {
+	var str string
+	switch context {
+	case "script":
+		// JSON can't close the <script> or attribute it's in, since it escapes <, > and &
+		if quote := jsStringQuote(prefix); quote != 0 {
+			// Inside a string literal the value is more of the string instead of a JSON value
+			encoded, _ := json.Marshal(fmt.Sprintf("%v", value))
+			str = strings.NewReplacer("'", `\u0027`, "`", `\u0060`, "$", `\u0024`).Replace(string(encoded[1 : len(encoded)-1]))
+		} else if encoded, err := json.Marshal(value); err == nil {
+			str = string(encoded)
+		} else {
+			str = "null"
+		}
+	case "url":
+		str = fmt.Sprintf("%v", value)
+		if strings.TrimSpace(prefix) == "" && !isSafeURL(str) {
+			str = "#ZgotmplZ"
+		} else if strings.ContainsAny(prefix, "?#") {
+			str = url.QueryEscape(str)
+		} else {
+			str = normalizeURL(str)
+		}
+	default:
+		// Text and attributes are escaped when the HTML is rendered
+		str = fmt.Sprintf("%v", value) // Like anyToString but doesn't wrap strings in quotes
+	}
+	return strings.NewReplacer("{", escapedOpenBrace, "}", escapedCloseBrace).Replace(str)
+}
+
+// jsStringQuote returns the quote of the JS string literal that's still open at the end of script, or 0 if there isn't one
+func jsStringQuote(script string) byte {
+	var quote byte
+	for i := 0; i < len(script); i++ {
+		switch c := script[i]; {
+		case quote != 0 && c == '\\':
+			i++
+		case quote != 0 && c == quote:
+			quote = 0
+		case quote == 0 && (c == '"' || c == '\'' || c == '`'):
+			quote = c
+		}
+	}
+	return quote
+}
+
+// isSafeURL allows relative URLs and the http, https, mailto and tel schemes
+func isSafeURL(str string) bool {
+	str = strings.ToLower(strings.TrimSpace(str))
+	end := strings.IndexAny(str, ":/?#")
+	if end == -1 || str[end] != ':' {
+		return true
+	}
+	switch str[:end] {
+	case "http", "https", "mailto", "tel":
+		return true
+	}
+	return false
+}
+
+// normalizeURL percent-encodes anything that isn't allowed in a URL while keeping its structure
+func normalizeURL(str string) string {
+	var out strings.Builder
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z') || ('0' <= c && c <= '9') || strings.IndexByte("-._~:/?#[]@!$&'()*+,;=%", c) != -1 {
+			out.WriteByte(c)
+		} else {
+			out.WriteString(fmt.Sprintf("%%%02X", c))
+		}
+	}
+	return out.String()
+}
+
+// clientTemplate turns an attribute value into the template literal Alpine binds on the client,
+// escaping each bracket the same way escapeValue does at build time
+func clientTemplate(str string, context string) string {
+	var out strings.Builder
+	for {
+		startPos := strings.IndexRune(str, '{')
+		if startPos == -1 {
+			break
+		}
+		endPos := strings.IndexRune(str[startPos:], '}')
+		if endPos == -1 {
+			break
+		}
+		endPos += startPos
+		out.WriteString(str[:startPos])
+		jsCode := str[startPos+1 : endPos]
+		switch {
+		case context == "script" && jsStringQuote(out.String()) != 0:
+			jsCode = "JSON.stringify(String(" + jsCode + ")).slice(1, -1).replace(/[\\x27\\x60$]/g, c => '\\\\u' + c.charCodeAt(0).toString(16).padStart(4, '0'))"
+		case context == "script":
+			jsCode = "JSON.stringify(" + jsCode + ")"
+		case context == "url" && strings.TrimSpace(out.String()) == "":
+			jsCode = "((url) => /^(?:(?:https?|mailto|tel):|[^:/?#]*(?:[/?#]|$))/i.test(url.trim()) ? url : '#ZgotmplZ')(String(" + jsCode + "))"
+		case context == "url" && strings.ContainsAny(out.String(), "?#"):
+			jsCode = "encodeURIComponent(" + jsCode + ")"
+		case context == "url":
+			jsCode = "encodeURI(" + jsCode + ")"
+		}
+		out.WriteString("${" + jsCode + "}")
+		str = str[endPos+1:]
+	}
+	out.WriteString(str)
+	return "`" + out.String() + "`"
 }
 
 type visitor struct {
@@ -409,55 +1062,566 @@ func generateRandom() (string, error) {
 	return string(bytes), nil
 }
 
-func templateParts(path string) (string, string, string, string) {
+// templateLayout records where the fence, script and style were cut out of a template,
+// so positions in the markup or fence can be traced back to the file for diagnostics
+type templateLayout struct {
+	template   string
+	markup     string
+	removed    [][]int // Start and end of each part cut out of the markup, in file order
+	fenceStart int     // File offset of the fence's JS, -1 when there's no fence
+}
+
+// markupOffset converts an index into the markup to an offset into the template file
+func (layout templateLayout) markupOffset(index int) int {
+	offset := index
+	for _, part := range layout.removed {
+		if part[0] > offset {
+			break
+		}
+		offset += part[1] - part[0]
+	}
+	return offset
+}
+
+// fenceOffset converts a line and column of the fence's JS to an offset into the template file
+func (layout templateLayout) fenceOffset(line int, column int) int {
+	if layout.fenceStart == -1 {
+		return -1
+	}
+	offset := layout.fenceStart
+	for ; line > 1; line-- {
+		next := strings.IndexRune(layout.template[offset:], '\n')
+		if next == -1 {
+			return -1
+		}
+		offset += next + 1
+	}
+	return offset + column - 1
+}
+
+// compiledTemplate is a template split into its parts and parsed, which only depends on the file
+type compiledTemplate struct {
+	fence       string
+	script      string
+	style       string
+	layout      templateLayout
+	imports     []Component
+	extends     string // The layout's path when the fence has an extends directive
+	propTypes   map[string]propType
+	required    []requiredProp
+	events      []string // The events declared with event name; that the component can $dispatch
+	allVars     []string
+	controlTree []control
+}
+
+// templateKey is what a compiled template depends on besides the file's contents
+type templateKey struct {
+	path string
+	trim bool // Config.TrimWhitespace, which changes the control tree that's built
+}
+
+// cachedTemplate is a compiled template along with what's needed to tell if it's still current
+type cachedTemplate struct {
+	tmpl *compiledTemplate
+	hash [sha256.Size]byte // Of the file's contents, an edit doesn't always change its size or modification time
+	used uint64            // When it was last used, by templateCache.clock
+}
+
+// maxCachedTemplates is how many compiled templates are kept, the least recently used one goes to make room
+var maxCachedTemplates = 512
+
+// templateCache holds the compiled templates, so components used many times are only parsed once
+var templateCache = struct {
+	sync.Mutex
+	templates map[templateKey]*cachedTemplate
+	clock     uint64
+}{templates: map[templateKey]*cachedTemplate{}}
+
+// compileTemplate returns the compiled template at path, reusing the cached one unless the file changed.
+// The returned template always has a layout, even with an error, so the error can be diagnosed
+func compileTemplate(path string, trimWhitespace bool) (*compiledTemplate, error) {
 	c, err := os.ReadFile(path)
 	if err != nil {
-		log.Fatal(err)
+		return &compiledTemplate{layout: templateLayout{fenceStart: -1}}, &Diagnostic{Path: path, Message: err.Error()}
+	}
+	key := templateKey{path: path, trim: trimWhitespace}
+	hash := sha256.Sum256(c)
+	templateCache.Lock()
+	cached := templateCache.templates[key]
+	if cached != nil && cached.hash == hash {
+		templateCache.clock++
+		cached.used = templateCache.clock
+		templateCache.Unlock()
+		return cached.tmpl, nil
+	}
+	templateCache.Unlock()
+
+	markup, fence, script, style, layout, err := templateParts(path, string(c))
+	tmpl := &compiledTemplate{
+		script: script,
+		style:  style,
+		layout: layout,
+	}
+	if err != nil {
+		return tmpl, err
+	}
+	// Get list of imported components and remove imports from fence
+	tmpl.fence, tmpl.imports = getComponents(path, fence)
+	tmpl.fence, tmpl.extends = getExtends(path, tmpl.fence)
+	tmpl.fence, tmpl.events, err = getEvents(tmpl.fence)
+	if err != nil {
+		return tmpl, err
+	}
+	tmpl.fence, tmpl.required, err = getRequiredProps(tmpl.fence)
+	if err != nil {
+		return tmpl, err
+	}
+	tmpl.fence, tmpl.propTypes, err = getPropTypes(tmpl.fence)
+	if err != nil {
+		return tmpl, err
+	}
+	// Get list of all variables declared in fence, props included since they become lets
+	tmpl.allVars = getAllVars(regexp.MustCompile(`\bprop `).ReplaceAllString(tmpl.fence, "let "))
+	// Build AST with {if} and {for} controls + text nodes
+	tmpl.controlTree, err = buildControlTree(markup, trimWhitespace || useTrim(fence))
+	if err != nil {
+		return tmpl, err
+	}
+	if err = buildSlots(tmpl.controlTree); err != nil {
+		return tmpl, err
+	}
+
+	templateCache.Lock()
+	if _, ok := templateCache.templates[key]; !ok && len(templateCache.templates) >= maxCachedTemplates {
+		var oldest *templateKey
+		for key, cached := range templateCache.templates {
+			if oldest == nil || cached.used < templateCache.templates[*oldest].used {
+				oldest = &key
+			}
+		}
+		delete(templateCache.templates, *oldest)
 	}
-	template := string(c)
+	templateCache.clock++
+	templateCache.templates[key] = &cachedTemplate{tmpl: tmpl, hash: hash, used: templateCache.clock}
+	templateCache.Unlock()
+	return tmpl, nil
+}
+
+func templateParts(path string, template string) (string, string, string, string, templateLayout, error) {
+	layout := templateLayout{fenceStart: -1}
+	layout.template = template
+	// Blank out comments so braces, --- or tags inside them can't be mistaken for template parts
+	masked := maskComments(template)
 	reFence := regexp.MustCompile(`(?s)---(.*?)---`)
 	reScript := regexp.MustCompile(`(?s)<script>(.*?)</script>`)
 	reStyle := regexp.MustCompile(`(?s)<style>(.*?)</style>`)
-	fences := reFence.FindAllStringSubmatch(template, -1)
-	scripts := reScript.FindAllStringSubmatch(template, -1)
-	styles := reStyle.FindAllStringSubmatch(template, -1)
+	fences := reFence.FindAllStringSubmatchIndex(masked, -1)
 	if len(fences) > 1 {
-		log.Fatal("Can only have one set of Fences (--- and ---) per template")
+		return "", "", "", "", layout, newDiagnostic(layout, path, fences[1][0], "Can only have one set of Fences (--- and ---) per template")
+	}
+	if len(fences) > 0 {
+		// Keep the fence's JS from being read as script or style tags
+		masked = masked[:fences[0][0]] + strings.Repeat(" ", fences[0][1]-fences[0][0]) + masked[fences[0][1]:]
 	}
+	scripts := reScript.FindAllStringSubmatchIndex(masked, -1)
+	styles := reStyle.FindAllStringSubmatchIndex(masked, -1)
 	if len(scripts) > 1 {
-		log.Fatal("Can only have one set of Script tags (<script></script>) per template")
+		return "", "", "", "", layout, newDiagnostic(layout, path, scripts[1][0], "Can only have one set of Script tags (<script></script>) per template")
 	}
 	if len(styles) > 1 {
-		log.Fatal("Can only have one set of Style tags (<style></style>) per template")
+		return "", "", "", "", layout, newDiagnostic(layout, path, styles[1][0], "Can only have one set of Style tags (<style></style>) per template")
 	}
-	markup := template
 	fence := ""
 	script := ""
 	style := ""
 	if len(fences) > 0 {
-		wrapped_fence := fences[0][0]
-		fence = fences[0][1]
-		markup = strings.Replace(markup, wrapped_fence, "", 1)
+		fence = maskComments(template[fences[0][2]:fences[0][3]])
+		layout.fenceStart = fences[0][2]
+		layout.removed = append(layout.removed, fences[0])
 	}
 	if len(scripts) > 0 {
-		wrapped_script := scripts[0][0]
-		script = scripts[0][1]
-		markup = strings.Replace(markup, wrapped_script, "", 1)
+		script = masked[scripts[0][2]:scripts[0][3]]
+		layout.removed = append(layout.removed, scripts[0])
 	}
 	if len(styles) > 0 {
-		wrapped_style := styles[0][0]
-		style = styles[0][1]
-		markup = strings.Replace(markup, wrapped_style, "", 1)
+		style = masked[styles[0][2]:styles[0][3]]
+		layout.removed = append(layout.removed, styles[0])
 	}
-	return markup, fence, script, style
+	sort.Slice(layout.removed, func(i, j int) bool {
+		return layout.removed[i][0] < layout.removed[j][0]
+	})
+	// Remove the parts from the markup, last first so the earlier indexes stay valid
+	markup := template
+	for i := len(layout.removed) - 1; i >= 0; i-- {
+		part := layout.removed[i]
+		markup = markup[:part[0]] + markup[part[1]:]
+	}
+	layout.markup = markup
+	return markup, fence, script, style, layout, nil
 }
 
-func setProps(fence string, props map[string]any) (string, string) {
+// maskComments replaces {!-- template comments --} with spaces, keeping newlines so line numbers don't move
+func maskComments(template string) string {
+	reComment := regexp.MustCompile(`(?s)\{!--.*?--\}`)
+	return reComment.ReplaceAllStringFunc(template, func(comment string) string {
+		return regexp.MustCompile(`[^\n]`).ReplaceAllString(comment, " ")
+	})
+}
+
+// propType is the type a prop is declared with, like prop age: number;
+type propType struct {
+	kind     string      // string, number, boolean, null, undefined, any, object, function, literal, array, union or shape
+	src      string      // The type as it was written, for error messages
+	literal  any         // The value of a literal type like "primary" or 3
+	elem     *propType   // The type of an array's elements
+	options  []propType  // The types a union can be
+	fields   []propField // The fields of an object shape like {name: string; age?: number}
+	position [2]int      // The line and column of the prop in the fence
+}
+
+type propField struct {
+	name     string
+	optional bool
+	typ      propType
+}
+
+// getEvents removes the event name; declarations from the fence and returns the event names
+func getEvents(fence string) (string, []string, error) {
+	events := []string{}
+	reEvent := regexp.MustCompile(`(?m)^[ \t]*event\s+([A-Za-z_$][\w$-]*)\s*;`)
+	for _, loc := range reEvent.FindAllStringSubmatchIndex(fence, -1) {
+		name := fence[loc[2]:loc[3]]
+		if !isEventName(name) {
+			line := strings.Count(fence[:loc[2]], "\n") + 1
+			column := loc[2] - strings.LastIndex(fence[:loc[2]], "\n")
+			return fence, nil, &fenceError{line: line, column: column, message: fmt.Sprintf("event %s has to be lowercase, HTML lowercases the on:%s attribute that listens for it", name, name)}
+		}
+		events = append(events, name)
+	}
+	return reEvent.ReplaceAllString(fence, ""), events, nil
+}
+
+// isEventName checks an event can be listened for with an attribute, which HTML lowercases
+func isEventName(name string) bool {
+	return regexp.MustCompile(`^[a-z_$][a-z0-9_$-]*$`).MatchString(name)
+}
+
+// requiredProp is a prop declared with prop! that has to be passed to the template
+type requiredProp struct {
+	name     string
+	position [2]int // The line and column of the prop in the fence
+}
+
+// getRequiredProps turns the prop! declarations in the fence into plain props and returns them
+func getRequiredProps(fence string) (string, []requiredProp, error) {
+	required := []requiredProp{}
+	reRequired := regexp.MustCompile(`(?m)^([ \t]*)prop!(\s+)([A-Za-z_$][\w$]*)`)
+	for _, loc := range reRequired.FindAllStringSubmatchIndex(fence, -1) {
+		name := fence[loc[6]:loc[7]]
+		line := strings.Count(fence[:loc[6]], "\n") + 1
+		column := loc[6] - strings.LastIndex(fence[:loc[6]], "\n")
+		statementEnd := indexTopLevel(fence[loc[7]:], ";")
+		if statementEnd == -1 {
+			return fence, nil, &fenceError{line: line, column: column, message: fmt.Sprintf("prop %s missing closing \";\"", name)}
+		}
+		if indexTopLevel(fence[loc[7]:loc[7]+statementEnd], "=") != -1 {
+			return fence, nil, &fenceError{line: line, column: column, message: fmt.Sprintf("prop! %s is required, so it can't have a default value", name)}
+		}
+		required = append(required, requiredProp{name: name, position: [2]int{line, column}})
+	}
+	return reRequired.ReplaceAllString(fence, "${1}prop${2}${3}"), required, nil
+}
+
+// checkRequiredProps makes sure every prop! was passed to the template at path, undefined doesn't count
+func checkRequiredProps(path string, required []requiredProp, props map[string]any) error {
+	missing := []string{}
+	var first requiredProp
+	for _, prop := range required {
+		if value, ok := props[prop.name]; !ok || value == nil {
+			if len(missing) == 0 {
+				first = prop
+			}
+			missing = append(missing, prop.name)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	label := "prop"
+	if len(missing) > 1 {
+		label = "props"
+	}
+	return &fenceError{line: first.position[0], column: first.position[1], message: fmt.Sprintf("missing required %s %s (declared in %s)", label, strings.Join(missing, ", "), path)}
+}
+
+// getPropTypes removes the type annotations from the props declared in the fence and returns them parsed.
+// The annotations' line breaks are moved after the declaration so the fence's line numbers don't change
+func getPropTypes(fence string) (string, map[string]propType, error) {
+	propTypes := map[string]propType{}
+	reProp := regexp.MustCompile(`(?m)^[ \t]*prop\s+([A-Za-z_$][\w$]*)\s*:`)
+	var out strings.Builder
+	pos := 0
+	for {
+		loc := reProp.FindStringSubmatchIndex(fence[pos:])
+		if loc == nil {
+			break
+		}
+		nameStart, nameEnd, typeStart := pos+loc[2], pos+loc[3], pos+loc[1]
+		name := fence[nameStart:nameEnd]
+		line := strings.Count(fence[:nameStart], "\n") + 1
+		column := nameStart - strings.LastIndex(fence[:nameStart], "\n")
+
+		// The type ends at the default value or the end of the declaration
+		typeEnd := indexTopLevel(fence[typeStart:], "=")
+		if semicolon := indexTopLevel(fence[typeStart:], ";"); typeEnd == -1 || (semicolon != -1 && semicolon < typeEnd) {
+			typeEnd = semicolon
+		}
+		if typeEnd == -1 {
+			return fence, nil, &fenceError{line: line, column: column, message: fmt.Sprintf("prop %s missing closing \";\"", name)}
+		}
+		typeEnd += typeStart
+		typ, err := parsePropType(fence[typeStart:typeEnd])
+		if err != nil {
+			return fence, nil, &fenceError{line: line, column: column, message: fmt.Sprintf("prop %s has an invalid type: %s", name, err)}
+		}
+		typ.position = [2]int{line, column}
+		propTypes[name] = typ
+
+		statementEnd := indexTopLevel(fence[typeEnd:], ";")
+		if statementEnd == -1 {
+			return fence, nil, &fenceError{line: line, column: column, message: fmt.Sprintf("prop %s missing closing \";\"", name)}
+		}
+		statementEnd += typeEnd + 1
+		declaration := ";"
+		if value := strings.TrimSpace(fence[typeEnd:statementEnd]); value != ";" {
+			declaration = " " + value
+		}
+		out.WriteString(fence[pos:nameEnd] + declaration)
+		out.WriteString(strings.Repeat("\n", strings.Count(fence[nameEnd:statementEnd], "\n")-strings.Count(declaration, "\n")))
+		pos = statementEnd
+	}
+	out.WriteString(fence[pos:])
+	return out.String(), propTypes, nil
+}
+
+// parsePropType parses a type like number, "a" | "b", string[] or {name: string; age?: number}
+func parsePropType(src string) (propType, error) {
+	src = strings.Join(strings.Fields(src), " ")
+	if src == "" {
+		return propType{}, fmt.Errorf("the type is empty")
+	}
+	if options := splitTopLevel(src, "|"); len(options) > 1 {
+		union := propType{kind: "union", src: src}
+		for _, option := range options {
+			if option == "" {
+				continue // A leading | like in | "a" | "b"
+			}
+			typ, err := parsePropType(option)
+			if err != nil {
+				return propType{}, err
+			}
+			union.options = append(union.options, typ)
+		}
+		return union, nil
+	}
+	if strings.HasSuffix(src, "[]") {
+		elem, err := parsePropType(src[:len(src)-len("[]")])
+		if err != nil {
+			return propType{}, err
+		}
+		return propType{kind: "array", src: src, elem: &elem}, nil
+	}
+	if strings.HasPrefix(src, "Array<") && strings.HasSuffix(src, ">") {
+		elem, err := parsePropType(src[len("Array<") : len(src)-len(">")])
+		if err != nil {
+			return propType{}, err
+		}
+		return propType{kind: "array", src: src, elem: &elem}, nil
+	}
+	if strings.HasPrefix(src, "(") && strings.HasSuffix(src, ")") {
+		return parsePropType(src[1 : len(src)-1])
+	}
+	if strings.HasPrefix(src, "{") && strings.HasSuffix(src, "}") {
+		shape := propType{kind: "shape", src: src}
+		body := strings.TrimSpace(src[1 : len(src)-1])
+		for _, field := range splitTopLevel(strings.ReplaceAll(body, ";", ","), ",") {
+			if field == "" {
+				continue
+			}
+			colon := indexTopLevel(field, ":")
+			if colon == -1 {
+				return propType{}, fmt.Errorf("field %q in %s is missing a type", field, src)
+			}
+			name := strings.TrimSpace(field[:colon])
+			optional := strings.HasSuffix(name, "?")
+			name = strings.Trim(strings.TrimSuffix(name, "?"), `"'`)
+			typ, err := parsePropType(field[colon+1:])
+			if err != nil {
+				return propType{}, err
+			}
+			shape.fields = append(shape.fields, propField{name: name, optional: optional, typ: typ})
+		}
+		return shape, nil
+	}
+	switch src {
+	case "string", "number", "boolean", "null", "undefined", "any", "unknown", "object", "function":
+		return propType{kind: strings.Replace(src, "unknown", "any", 1), src: src}, nil
+	case "true", "false":
+		return propType{kind: "literal", src: src, literal: src == "true"}, nil
+	}
+	if (strings.HasPrefix(src, `"`) && strings.HasSuffix(src, `"`)) || (strings.HasPrefix(src, "'") && strings.HasSuffix(src, "'")) {
+		if len(src) >= 2 {
+			return propType{kind: "literal", src: src, literal: src[1 : len(src)-1]}, nil
+		}
+	}
+	if number, err := strconv.ParseFloat(src, 64); err == nil {
+		return propType{kind: "literal", src: src, literal: number}, nil
+	}
+	return propType{}, fmt.Errorf("unknown type %s", src)
+}
+
+// check returns an error when value doesn't match the type, name is the prop or the path to the field in it
+func (t propType) check(value any, name string) error {
+	mismatch := fmt.Errorf("%s should be %s but got %s", name, t.src, describeValue(value))
+	val := reflect.ValueOf(value)
+	switch t.kind {
+	case "any":
+		return nil
+	case "string":
+		if val.Kind() == reflect.String {
+			return nil
+		}
+	case "number":
+		if _, ok := toFloat(value); ok {
+			return nil
+		}
+	case "boolean":
+		if val.Kind() == reflect.Bool {
+			return nil
+		}
+	case "null", "undefined":
+		if value == nil {
+			return nil
+		}
+	case "object":
+		if val.Kind() == reflect.Map || val.Kind() == reflect.Struct {
+			return nil
+		}
+	case "function":
+		if val.Kind() == reflect.Func {
+			return nil
+		}
+	case "literal":
+		if number, ok := t.literal.(float64); ok {
+			if f, ok := toFloat(value); ok && f == number {
+				return nil
+			}
+		} else if value == t.literal {
+			return nil
+		}
+	case "union":
+		for _, option := range t.options {
+			if option.check(value, name) == nil {
+				return nil
+			}
+		}
+	case "array":
+		if val.Kind() != reflect.Slice && val.Kind() != reflect.Array {
+			break
+		}
+		for i := 0; i < val.Len(); i++ {
+			if err := t.elem.check(val.Index(i).Interface(), fmt.Sprintf("%s[%d]", name, i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "shape":
+		if val.Kind() != reflect.Map || val.Type().Key().Kind() != reflect.String {
+			break
+		}
+		for _, field := range t.fields {
+			fieldValue := val.MapIndex(reflect.ValueOf(field.name).Convert(val.Type().Key()))
+			if !fieldValue.IsValid() {
+				if field.optional {
+					continue
+				}
+				return fmt.Errorf("%s should be %s but is missing %s", name, t.src, field.name)
+			}
+			if err := field.typ.check(fieldValue.Interface(), name+"."+field.name); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return mismatch
+}
+
+// toFloat returns the value of any Go number type as a float64
+func toFloat(value any) (float64, bool) {
+	val := reflect.ValueOf(value)
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(val.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(val.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return val.Float(), true
+	}
+	return 0, false
+}
+
+// describeValue names the JS type of a value for error messages, with the value itself when it's short
+func describeValue(value any) string {
+	val := reflect.ValueOf(value)
+	switch {
+	case value == nil:
+		return "null"
+	case val.Kind() == reflect.String:
+		if len(value.(string)) > 40 {
+			return "a string"
+		}
+		return "string " + strconv.Quote(value.(string))
+	case val.Kind() == reflect.Bool:
+		return fmt.Sprintf("boolean %v", value)
+	case val.Kind() == reflect.Slice || val.Kind() == reflect.Array:
+		return "an array"
+	case val.Kind() == reflect.Map || val.Kind() == reflect.Struct:
+		return "an object"
+	case val.Kind() == reflect.Func:
+		return "a function"
+	}
+	if _, ok := toFloat(value); ok {
+		return fmt.Sprintf("number %v", value)
+	}
+	return fmt.Sprintf("%T", value)
+}
+
+// checkPropTypes checks the props passed to the template at path against the types they're declared with
+func checkPropTypes(path string, propTypes map[string]propType, props map[string]any) error {
+	names := make([]string, 0, len(propTypes))
+	for name := range propTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		value, ok := props[name]
+		if !ok {
+			continue
+		}
+		typ := propTypes[name]
+		if err := typ.check(value, name); err != nil {
+			return &fenceError{line: typ.position[0], column: typ.position[1], message: fmt.Sprintf("prop %s (declared in %s)", err, path)}
+		}
+	}
+	return nil
+}
+
+func setProps(fence string, props map[string]any) (string, string) {
 	fence_logic := fence
 	for name, value := range props {
 		reProp := regexp.MustCompile(fmt.Sprintf(`prop (%s)(\s?=\s?(.*?))?;`, name))
 		fence_logic = reProp.ReplaceAllString(fence_logic, "")
-		fence = reProp.ReplaceAllString(fence, "let "+name+" = "+anyToString(value)+";")
+		fence = reProp.ReplaceAllLiteralString(fence, "let "+name+" = "+anyToString(value)+";")
 	}
 	// Convert prop to let for unpassed props
 	rePropDefaults := regexp.MustCompile(`prop (.*?);`)
@@ -481,6 +1645,60 @@ func makeAttrStr(str string) string {
 	return str
 }
 
+// makeExprAttr prepares a JS expression for an attribute by switching its double
+// quoted strings to single quotes, unlike makeAttrStr it leaves existing single quotes alone
+func makeExprAttr(expr string) string {
+	var out strings.Builder
+	var quote byte
+	for i := 0; i < len(expr); i++ {
+		c := expr[i]
+		if quote == '"' {
+			if c == '\\' && i+1 < len(expr) && expr[i+1] == '"' {
+				out.WriteByte('"')
+				i++
+			} else if c == '\\' && i+1 < len(expr) {
+				out.WriteByte(c)
+				out.WriteByte(expr[i+1])
+				i++
+			} else if c == '\'' {
+				out.WriteString("\\'")
+			} else if c == '"' {
+				out.WriteByte('\'')
+				quote = 0
+			} else {
+				out.WriteByte(c)
+			}
+			continue
+		}
+		if quote != 0 {
+			if c == '\\' && i+1 < len(expr) {
+				out.WriteByte(c)
+				out.WriteByte(expr[i+1])
+				i++
+				continue
+			}
+			if c == quote {
+				quote = 0
+			}
+			out.WriteByte(c)
+			continue
+		}
+		switch c {
+		case '"':
+			quote = c
+			out.WriteByte('\'')
+		case '\'', '`':
+			quote = c
+			out.WriteByte(c)
+		case '\n':
+			out.WriteByte(' ')
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return strings.TrimSpace(out.String())
+}
+
 func getAllVars(fence string) []string {
 	allVars := []string{}
 	reAllVars := regexp.MustCompile(`(?:let|const|var) (?P<name>.*?)(?:\s?=\s?(?P<value>.*?))?;`)
@@ -494,20 +1712,41 @@ func getAllVars(fence string) []string {
 	return allVars
 }
 
-func evaluateProps(fence string, allVars []string, props map[string]any) map[string]any {
+func evaluateProps(fence string, allVars []string, props map[string]any, contextValues map[string]any) (map[string]any, map[string]any, error) {
 	vm := goja.New()
-	vm.RunString(fence)
+	setValues := map[string]any{}
+	vm.Set("setContext", func(key string, value goja.Value) goja.Value {
+		setValues[key] = value.Export()
+		return value
+	})
+	vm.Set("getContext", func(key string) goja.Value {
+		if value, ok := setValues[key]; ok {
+			return vm.ToValue(value)
+		}
+		if value, ok := contextValues[key]; ok {
+			return vm.ToValue(value)
+		}
+		return goja.Undefined()
+	})
+	_, err := vm.RunString(fence)
+	if err != nil {
+		line, column := jsPosition(err)
+		return props, setValues, &fenceError{line: line, column: column, message: jsMessage(err)}
+	}
 	for _, name := range allVars {
 		evaluated_value := vm.Get(name).Export()
 		if evaluated_value == nil {
 			evaluated_value = ""
 		}
+		if promise, ok := evaluated_value.(*goja.Promise); ok {
+			evaluated_value = exportPromise(promise)
+		}
 		props[name] = evaluated_value
 	}
-	return props
+	return props, setValues, nil
 }
 
-func evalAllBrackets(str string, props map[string]any) string {
+func evalAllBrackets(str string, props map[string]any) (string, error) {
 	for {
 		startPos := strings.IndexRune(str, '{')
 		endPos := strings.IndexRune(str, '}')
@@ -515,10 +1754,14 @@ func evalAllBrackets(str string, props map[string]any) string {
 			break
 		}
 		jsCode := str[startPos+1 : endPos]
-		evaluated := fmt.Sprintf("%v", evalJS(jsCode, props)) // Like anyToString but doesn't wrap strings in quotes
+		value, err := evalJS(jsCode, props)
+		if err != nil {
+			return "", err
+		}
+		evaluated := fmt.Sprintf("%v", value) // Like anyToString but doesn't wrap strings in quotes
 		str = str[0:startPos] + evaluated + str[endPos+1:]
 	}
-	return str
+	return str, nil
 }
 
 func declProps(props map[string]any) string {
@@ -529,15 +1772,14 @@ func declProps(props map[string]any) string {
 	return props_decl
 }
 
-func evalJS(jsCode string, props map[string]any) any {
+func evalJS(jsCode string, props map[string]any) (any, error) {
 	props_decl := declProps(props)
 	vm := goja.New()
 	goja_value, err := vm.RunString(props_decl + jsCode)
 	if err != nil {
-		return ""
-		//return jsCode
+		return "", &markupError{index: -1, expr: jsCode, message: fmt.Sprintf("{%s} failed: %s", jsCode, jsMessage(err))}
 	}
-	return goja_value.Export()
+	return goja_value.Export(), nil
 }
 
 // Helper function to check if a character is uppercase
@@ -545,113 +1787,673 @@ func isUpper(c byte) bool {
 	return c >= 'A' && c <= 'Z'
 }
 
-type control struct {
-	isIfStmt    bool
-	ifCondition string
+// findTagEnd returns the index of the "}" that closes the tag opened at markup[start],
+// skipping over nested braces and quoted strings, or -1 if the tag is never closed
+func findTagEnd(markup string, start int) int {
+	depth := 0
+	var quote byte
+	for i := start; i < len(markup); i++ {
+		c := markup[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'', '`':
+			quote = c
+		case '{', '[', '(':
+			depth++
+		case '}', ']', ')':
+			depth--
+			if depth == 0 && c == '}' {
+				return i
+			}
+		}
+	}
+	return -1
+}
 
-	isElseIfStmt    bool
-	elseIfCondition string
+// indexTopLevel returns the index of the first occurrence of substr in str
+// that isn't nested inside brackets or quoted strings, or -1 if there is none
+func indexTopLevel(str string, substr string) int {
+	depth := 0
+	var quote byte
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if quote != 0 {
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		if depth == 0 && strings.HasPrefix(str[i:], substr) {
+			return i
+		}
+		switch c {
+		case '"', '\'', '`':
+			quote = c
+		case '{', '[', '(':
+			depth++
+		case '}', ']', ')':
+			depth--
+		}
+	}
+	return -1
+}
 
-	isElseStmt bool
+// parseForHeader splits "let [i, item] of items.entries() key item.id" into its
+// binding pattern, optional index name, collection and optional key expression
+func parseForHeader(header string) (control, error) {
+	reDecl := regexp.MustCompile(`^\s*(?:let|var|const)\s+`)
+	decl := reDecl.FindString(header)
+	if decl == "" {
+		return control{}, fmt.Errorf("missing let, var or const declaration")
+	}
+	rest := header[len(decl):]
 
-	isForLoop     bool
-	forVar        string
-	forCollection string
+	var pattern string
+	if strings.HasPrefix(rest, "[") || strings.HasPrefix(rest, "{") {
+		// Destructuring pattern, find where it's closed
+		end := indexTopLevel(rest, " ")
+		if end == -1 {
+			end = len(rest)
+		}
+		pattern = strings.TrimRight(rest[:end], ",")
+		if getBindingNames(pattern) == nil {
+			return control{}, fmt.Errorf("has invalid destructuring pattern %q", pattern)
+		}
+	} else {
+		pattern = regexp.MustCompile(`^[\w$]+`).FindString(rest)
+		if pattern == "" {
+			return control{}, fmt.Errorf("missing iterator")
+		}
+	}
+	rest = rest[len(pattern):]
 
-	isTextNode  bool
-	textContent string
+	reIndex := regexp.MustCompile(`^\s*,\s*([\w$]+)`)
+	index := ""
+	if matches := reIndex.FindStringSubmatch(rest); matches != nil {
+		index = matches[1]
+		rest = rest[len(matches[0]):]
+	}
 
-	isComp    bool
-	compName  string
-	compProps map[string]any
+	reOf := regexp.MustCompile(`^\s+(of|in)\s+`)
+	of := reOf.FindStringSubmatch(rest)
+	if of == nil {
+		return control{}, fmt.Errorf("missing iterator / collection")
+	}
+	collection := rest[len(of[0]):]
 
-	isDynamicComp    bool
-	dynamicCompPath  string
-	dynamicCompProps map[string]any
+	key := ""
+	if keyPos := indexTopLevel(collection, " key "); keyPos != -1 {
+		key = strings.TrimSpace(collection[keyPos+len(" key "):])
+		collection = collection[:keyPos]
+	}
+	collection = strings.TrimSpace(collection)
+	if collection == "" {
+		return control{}, fmt.Errorf("missing collection")
+	}
 
-	children []control
+	return control{
+		isForLoop:     true,
+		forVar:        pattern,
+		forIndex:      index,
+		forIn:         of[1] == "in",
+		forCollection: collection,
+		forKey:        key,
+	}, nil
 }
 
-func buildControlTree(markup string) ([]control, error) {
-	var controlTree []control
-	var controlStack []*control
-	var openControl *control
-	for i := 0; i < len(markup); {
-		if strings.HasPrefix(markup[i:], "{if ") {
-			startOpenIfIndex := i
-
-			relativeEndOpenIfIndex := strings.Index(markup[startOpenIfIndex:], "}")
-			if relativeEndOpenIfIndex == -1 {
-				return nil, fmt.Errorf("{if ...} condition missing closing \"}\" at index %d", startOpenIfIndex)
-			}
-			endOpenIfIndex := startOpenIfIndex + relativeEndOpenIfIndex
+// getBindingNames lists the variables declared by an identifier or destructuring pattern
+func getBindingNames(pattern string) []string {
+	ast, err := js.Parse(parse.NewInputString("let "+pattern+" = undefined;"), js.Options{})
+	if err != nil {
+		return nil
+	}
+	names := []string{}
+	for _, v := range ast.BlockStmt.Scope.Declared {
+		names = append(names, string(v.Data))
+	}
+	return names
+}
 
-			ifCondition := markup[startOpenIfIndex+len("{if ") : endOpenIfIndex]
+type forIteration struct {
+	bindings map[string]any
+	key      any
+}
 
-			newControl := control{
-				isIfStmt:    true,
-				ifCondition: ifCondition,
-			}
+// rangeHelper is available to {for} collections, e.g. {for let n of range(1, 10)}
+// counts from 1 up to (but not including) 10
+const rangeHelper = `function range(start, end, step) {
+	if (end === undefined) { end = start; start = 0; }
+	if (step === undefined) { step = start <= end ? 1 : -1; }
+	if (step === 0) { throw new RangeError("range() step can't be 0"); }
+	const numbers = [];
+	for (let n = start; step > 0 ? n < end : n > end; n += step) { numbers.push(n); }
+	return numbers;
+}
+`
 
-			if openControl != nil {
-				openControl.children = append(openControl.children, newControl)
-				controlStack = append(controlStack, &openControl.children[len(openControl.children)-1])
-			} else {
-				controlTree = append(controlTree, newControl)
-				controlStack = append(controlStack, &controlTree[len(controlTree)-1])
-			}
-			openControl = controlStack[len(controlStack)-1]
+// iterateCollection turns the collection of a {for} loop into an array, throwing
+// for anything that can't be looped over instead of rendering nothing
+const iterateCollection = `function _plenti_iterate(collection, keys) {
+	if (keys) {
+		if (collection === null || typeof collection !== "object") {
+			throw new TypeError("can't loop over the keys of " + collection);
+		}
+		return collection instanceof Map ? Array.from(collection.keys()) : Object.keys(collection);
+	}
+	if (collection === null || collection === undefined || typeof collection[Symbol.iterator] !== "function") {
+		throw new TypeError(collection + " is not iterable");
+	}
+	return Array.from(collection);
+}
+`
 
-			i = endOpenIfIndex + 1
-		} else if strings.HasPrefix(markup[i:], "{for ") {
-			startOpenForIndex := i
-			relativeEndOpenForIndex := strings.Index(markup[startOpenForIndex:], "}")
-			if relativeEndOpenForIndex == -1 {
-				return nil, fmt.Errorf("{for } loop missing closing \"}\" at index %d", startOpenForIndex)
-			}
-			endOpenForIndex := startOpenForIndex + relativeEndOpenForIndex
+// evalForLoop evaluates the collection of a {for} loop in Goja and binds the
+// pattern, index and key for each item so destructuring follows JS semantics
+func evalForLoop(ctrl control, props map[string]any) ([]forIteration, error) {
+	names := getBindingNames(ctrl.forVar)
+	if ctrl.forIndex != "" {
+		names = append(names, ctrl.forIndex)
+	}
+	key := "undefined"
+	if ctrl.forKey != "" {
+		key = ctrl.forKey
+	}
+	indexDecl := ""
+	if ctrl.forIndex != "" {
+		indexDecl = fmt.Sprintf("let %s = _plenti_index;", ctrl.forIndex)
+	}
+	loop := fmt.Sprintf("_plenti_iterate(%s, %t).map((_plenti_item, _plenti_index) => { let %s = _plenti_item; %s return [{%s}, %s]; });",
+		ctrl.forCollection, ctrl.forIn, ctrl.forVar, indexDecl, strings.Join(names, ", "), key)
 
-			re := regexp.MustCompile(`for (?:let|var|const) (\w+) (?:of|in) (.*)`)
-			matches := re.FindStringSubmatch(markup[startOpenForIndex:endOpenForIndex])
-			if len(matches) < 2 {
-				return nil, fmt.Errorf("{for } loop missing iterator / collection \"}\" at index %d", startOpenForIndex)
-			}
+	vm := goja.New()
+	goja_value, err := vm.RunString(rangeHelper + iterateCollection + declProps(props) + loop)
+	if err != nil {
+		return nil, fmt.Errorf("{for } loop over %q failed: %s", ctrl.forCollection, jsMessage(err))
+	}
+	results, ok := goja_value.Export().([]any)
+	if !ok {
+		return nil, fmt.Errorf("{for } loop over %q is not iterable", ctrl.forCollection)
+	}
 
-			newControl := control{
-				isForLoop:     true,
-				forVar:        matches[1],
-				forCollection: matches[2],
-			}
-			if openControl != nil {
-				openControl.children = append(openControl.children, newControl)
-				controlStack = append(controlStack, &openControl.children[len(openControl.children)-1])
-			} else {
-				controlTree = append(controlTree, newControl)
-				controlStack = append(controlStack, &controlTree[len(controlTree)-1])
-			}
-			openControl = controlStack[len(controlStack)-1]
+	iterations := []forIteration{}
+	for _, result := range results {
+		pair := result.([]any)
+		bindings, _ := pair[0].(map[string]any)
+		iterations = append(iterations, forIteration{
+			bindings: bindings,
+			key:      pair[1],
+		})
+	}
+	return iterations, nil
+}
 
-			i = endOpenForIndex + 1
-		} else if strings.HasPrefix(markup[i:], "{else if ") {
-			if openControl == nil {
-				return nil, fmt.Errorf("{else if} at index %d missing opening {if}", i)
-			}
-			startElseIfIndex := i
+// controlTags are the tags that end a text node and start a control node
+var controlTags = []string{
+	"{if ", "{else if ", "{else}", "{/if}",
+	"{for ", "{/for}",
+	"{switch ", "{case ", "{default}", "{/switch}",
+	"{await ", "{then}", "{then ", "{catch}", "{catch ", "{/await}",
+	"{const ", "{let ",
+	"{block ", "{/block}",
+	"{@html ",
+	"{!--",
+}
 
-			relativeEndElseIfIndex := strings.Index(markup[startElseIfIndex:], "}")
-			if relativeEndElseIfIndex == -1 {
-				return nil, fmt.Errorf("{else if} condition missing closing \"}\" at index %d", startElseIfIndex)
-			}
-			endElseIfIndex := startElseIfIndex + relativeEndElseIfIndex
+// isControlStart checks if a control node (tag, component or dynamic component) starts at markup[i]
+func isControlStart(markup string, i int) bool {
+	if strings.HasPrefix(markup[i:], "<=") || (i+1 < len(markup) && markup[i] == '<' && isUpper(markup[i+1])) {
+		return true
+	}
+	if i+2 < len(markup) && strings.HasPrefix(markup[i:], "</") && isUpper(markup[i+2]) {
+		return true
+	}
+	if isSelfStart(markup, i) || strings.HasPrefix(markup[i:], "</self>") {
+		return true
+	}
+	if isSlotStart(markup, i) || strings.HasPrefix(markup[i:], "</slot>") {
+		return true
+	}
+	for _, tag := range controlTags {
+		if strings.HasPrefix(markup[i:], tag) {
+			return true
+		}
+	}
+	return false
+}
 
-			elseIfCondition := markup[startElseIfIndex+len("{else if ") : endElseIfIndex]
+// trimmedChar marks the bytes removed by whitespace trimming so indexes into the markup don't shift
+const trimmedChar = '\x00'
 
-			if openControl.isElseIfStmt {
-				controlStack = controlStack[:len(controlStack)-1] // Pop from stack
+// markTrimmed blanks the whitespace removed by trim markers ({-if ...} trims before the tag,
+// {/for-} after it) with trimmedChar. When trimWhitespace is set, control tags that sit on
+// their own line also lose their indentation and line break
+func markTrimmed(markup string, trimWhitespace bool) string {
+	out := []byte(markup)
+	for i := 0; i < len(markup); i++ {
+		if markup[i] != '{' {
+			continue
+		}
+		end := findTagEnd(markup, i)
+		if strings.HasPrefix(markup[i:], "{!--") {
+			end = strings.Index(markup[i:], "--}")
+			if end != -1 {
+				end += i + len("--")
+			}
+		}
+		if end == -1 {
+			continue
+		}
+		tag := markup[i : end+1]
+		trimLeft := strings.HasPrefix(tag, "{-")
+		trimRight := len(tag) > len("{--}") && strings.HasSuffix(tag, "-}") && !strings.HasSuffix(tag, "--}")
+		if trimLeft {
+			tag = "{" + tag[len("{-"):]
+		}
+		if trimRight {
+			tag = tag[:len(tag)-len("-}")] + "}"
+		}
+		if !isTrimmable(tag) {
+			// Skip over expressions so braces inside them aren't read as tags
+			i = end
+			continue
+		}
+		if trimLeft {
+			out[i] = trimmedChar
+			out[i+1] = '{'
+			for j := i - 1; j >= 0 && isSpace(markup[j]); j-- {
+				out[j] = trimmedChar
+			}
+		} else if trimWhitespace {
+			j := i - 1
+			for j >= 0 && (markup[j] == ' ' || markup[j] == '\t') {
+				j--
+			}
+			if j < 0 || markup[j] == '\n' {
+				for k := j + 1; k < i; k++ {
+					out[k] = trimmedChar
+				}
+			}
+		}
+		if trimRight {
+			out[end-1] = '}'
+			out[end] = trimmedChar
+			for j := end + 1; j < len(markup) && isSpace(markup[j]); j++ {
+				out[j] = trimmedChar
+			}
+		} else if trimWhitespace {
+			j := end + 1
+			for j < len(markup) && (markup[j] == ' ' || markup[j] == '\t' || markup[j] == '\r') {
+				j++
+			}
+			if j == len(markup) || markup[j] == '\n' {
+				for k := end + 1; k < len(markup) && k <= j; k++ {
+					out[k] = trimmedChar
+				}
+			}
+		}
+		i = end
+	}
+	return string(out)
+}
+
+// isTrimmable checks if tag is a control tag whose surrounding whitespace can be trimmed,
+// {@html} is left alone since it renders content
+func isTrimmable(tag string) bool {
+	if strings.HasPrefix(tag, "{@html ") {
+		return false
+	}
+	for _, controlTag := range controlTags {
+		if strings.HasPrefix(tag, controlTag) {
+			return true
+		}
+	}
+	return false
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// useTrim checks if the component's fence has the "use trim"; directive
+func useTrim(fence string) bool {
+	reUseTrim := regexp.MustCompile(`(?m)^\s*["']use trim["'];?\s*$`)
+	return reUseTrim.MatchString(fence)
+}
+
+// isSlotStart checks if a <slot> outlet starts at markup[i]
+func isSlotStart(markup string, i int) bool {
+	return strings.HasPrefix(markup[i:], "<slot") && i+len("<slot") < len(markup) && strings.ContainsRune(" \t\n/>", rune(markup[i+len("<slot")]))
+}
+
+// isSelfStart checks for a lowercase <self> tag, which is the same as <Self>
+func isSelfStart(markup string, i int) bool {
+	return strings.HasPrefix(markup[i:], "<self") && i+len("<self") < len(markup) && strings.ContainsRune(" \t\n/>"+string(trimmedChar), rune(markup[i+len("<self")]))
+}
+
+// findElementEnd returns the index of the ">" that ends the tag opened at markup[start],
+// skipping over {} expressions and quoted attribute values, or -1 if the tag is never closed
+func findElementEnd(markup string, start int) int {
+	depth := 0
+	var quote byte
+	for i := start; i < len(markup); i++ {
+		c := markup[i]
+		if quote != 0 {
+			if c == '\\' && depth > 0 {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+			continue
+		}
+		switch c {
+		case '"', '\'':
+			quote = c
+		case '`':
+			if depth > 0 {
+				quote = c
+			}
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case '>':
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitTopLevel splits str around each sep that isn't nested inside brackets or quoted strings
+func splitTopLevel(str string, sep string) []string {
+	parts := []string{}
+	for {
+		pos := indexTopLevel(str, sep)
+		if pos == -1 {
+			break
+		}
+		parts = append(parts, strings.TrimSpace(str[:pos]))
+		str = str[pos+len(sep):]
+	}
+	return append(parts, strings.TrimSpace(str))
+}
+
+// evalSwitch evaluates the {switch} discriminant once and returns the first
+// {case} that strictly equals it, falling back on {default}
+func evalSwitch(ctrl control, props map[string]any) (*control, error) {
+	vm := goja.New()
+	_, err := vm.RunString(declProps(props) + "const _plenti_switch = (" + ctrl.switchExpr + ");")
+	if err != nil {
+		return nil, fmt.Errorf("{switch %s} failed: %s", ctrl.switchExpr, jsMessage(err))
+	}
+	var defaultBranch *control
+	for i, child := range ctrl.children {
+		if child.isDefaultStmt {
+			defaultBranch = &ctrl.children[i]
+		}
+		if !child.isCaseStmt {
+			continue
+		}
+		matched, err := vm.RunString("[" + strings.Join(child.caseValues, ", ") + "].some(value => value === _plenti_switch);")
+		if err != nil {
+			return nil, fmt.Errorf("{case %s} failed: %s", strings.Join(child.caseValues, ", "), jsMessage(err))
+		}
+		if matched.ToBoolean() {
+			return &ctrl.children[i], nil
+		}
+	}
+	return defaultBranch, nil
+}
+
+// promiseResult keeps the state of a fence promise so it can be declared again in later Goja runtimes
+type promiseResult struct {
+	state goja.PromiseState
+	value any
+}
+
+// exportPromise converts a promise that's been through Goja's job queue into a promiseResult
+func exportPromise(promise *goja.Promise) promiseResult {
+	result := promiseResult{state: promise.State()}
+	if promise.State() != goja.PromiseStatePending {
+		result.value = exportReason(promise.Result())
+	}
+	return result
+}
+
+// exportReason exports a JS value, keeping the name and message of errors that would otherwise export as {}
+func exportReason(value goja.Value) any {
+	if obj, ok := value.(*goja.Object); ok && obj.ClassName() == "Error" {
+		return map[string]any{
+			"name":    obj.Get("name").String(),
+			"message": obj.Get("message").String(),
+		}
+	}
+	return value.Export()
+}
+
+// evalAwait returns the {await} branch to render and the value it binds. Goja drains its
+// job queue before RunString returns, so a promise that's still pending will never settle at build time
+func evalAwait(ctrl control, props map[string]any) (*control, any, error) {
+	vm := goja.New()
+	goja_value, err := vm.RunString(declProps(props) + ctrl.awaitExpr)
+	if err != nil {
+		return nil, nil, fmt.Errorf("{await %s} failed: %s", ctrl.awaitExpr, jsMessage(err))
+	}
+
+	var branch *control
+	var value any
+	promise, ok := goja_value.Export().(*goja.Promise)
+	if !ok {
+		// Awaiting a value that isn't a promise resolves to the value itself
+		branch = getAwaitBranch(ctrl, "then")
+		value = goja_value.Export()
+	} else if promise.State() == goja.PromiseStateFulfilled {
+		branch = getAwaitBranch(ctrl, "then")
+		value = promise.Result().Export()
+	} else if promise.State() == goja.PromiseStateRejected {
+		branch = getAwaitBranch(ctrl, "catch")
+		value = exportReason(promise.Result())
+	} else {
+		branch = &control{children: getPendingChildren(ctrl)}
+	}
+	return branch, value, nil
+}
+
+// getAwaitBranch returns the {then} or {catch} branch of an {await} block
+func getAwaitBranch(ctrl control, kind string) *control {
+	for i, child := range ctrl.children {
+		if (kind == "then" && child.isThenStmt) || (kind == "catch" && child.isCatchStmt) {
+			return &ctrl.children[i]
+		}
+	}
+	return nil
+}
+
+// getPendingChildren returns the children of an {await} block that come before its {then} and {catch} branches
+func getPendingChildren(ctrl control) []control {
+	pending := []control{}
+	for _, child := range ctrl.children {
+		if child.isThenStmt || child.isCatchStmt {
+			break
+		}
+		pending = append(pending, child)
+	}
+	return pending
+}
+
+// evalBinding evaluates a {const} or {let} tag, destructuring the value like JS would
+func evalBinding(ctrl control, props map[string]any) (map[string]any, error) {
+	names := getBindingNames(ctrl.bindingPattern)
+	vm := goja.New()
+	goja_value, err := vm.RunString(fmt.Sprintf("%s(() => { let %s = (%s); return {%s}; })();",
+		declProps(props), ctrl.bindingPattern, ctrl.bindingExpr, strings.Join(names, ", ")))
+	if err != nil {
+		return nil, fmt.Errorf("{%s %s = %s} failed: %s", ctrl.bindingKeyword, ctrl.bindingPattern, ctrl.bindingExpr, jsMessage(err))
+	}
+	bindings, _ := goja_value.Export().(map[string]any)
+	return bindings, nil
+}
+
+type control struct {
+	isIfStmt    bool
+	ifCondition string
+
+	isElseIfStmt    bool
+	elseIfCondition string
+
+	isElseStmt bool
+
+	isForLoop     bool
+	forVar        string // identifier or destructuring pattern
+	forIndex      string
+	forIn         bool // "in" walks object keys, "of" walks any iterable
+	forCollection string
+	forKey        string
+
+	isSwitchStmt bool
+	switchExpr   string
+
+	isCaseStmt bool
+	caseValues []string
+
+	isDefaultStmt bool
+
+	isAwaitBlock    bool
+	awaitExpr       string
+	awaitClientOnly bool
+
+	isThenStmt  bool
+	isCatchStmt bool
+	awaitVar    string
+
+	isBinding      bool
+	bindingKeyword string // const or let, as it was written
+	bindingPattern string
+	bindingExpr    string
+
+	isRawHTML   bool
+	rawHTMLExpr string
+
+	isTextNode  bool
+	textContent string
+
+	isComp    bool
+	compName  string
+	compProps map[string]any
+	// {...expr} objects spread into the props of the component or dynamic component
+	compSpreads []string
+	// on:event={handler} attributes of the component or dynamic component
+	compEvents map[string]string
+	// The client: directive of the component or dynamic component
+	compClient string
+	// The content between the component's tags, kept as markup so it can be split up by slot
+	slotMarkup string
+	slotStart  int
+	slotEnd    int
+	slotLets   map[string]string       // let:prop={name} bindings for the default slot
+	slots      map[string]*slotContent // The content split up by slot, built once when the template is compiled
+
+	isSlot    bool
+	slotName  string
+	slotProps map[string]any
+
+	isBlock   bool
+	blockName string
+
+	isDynamicComp    bool
+	dynamicCompPath  string
+	dynamicCompProps map[string]any
+
+	index    int // Where the node starts in the markup
+	children []control
+}
+
+func buildControlTree(markup string, trimWhitespace bool) ([]control, error) {
+	markup = markTrimmed(markup, trimWhitespace)
+	var controlTree []control
+	var controlStack []*control
+	var openControl *control
+	for i := 0; i < len(markup); {
+		if strings.HasPrefix(markup[i:], "{if ") {
+			startOpenIfIndex := i
+
+			relativeEndOpenIfIndex := strings.Index(markup[startOpenIfIndex:], "}")
+			if relativeEndOpenIfIndex == -1 {
+				return nil, markupErrorf(startOpenIfIndex, "{if ...} condition missing closing \"}\"")
+			}
+			endOpenIfIndex := startOpenIfIndex + relativeEndOpenIfIndex
+
+			ifCondition := markup[startOpenIfIndex+len("{if ") : endOpenIfIndex]
+
+			newControl := control{
+				index:       i,
+				isIfStmt:    true,
+				ifCondition: ifCondition,
+			}
+
+			if openControl != nil {
+				openControl.children = append(openControl.children, newControl)
+				controlStack = append(controlStack, &openControl.children[len(openControl.children)-1])
+			} else {
+				controlTree = append(controlTree, newControl)
+				controlStack = append(controlStack, &controlTree[len(controlTree)-1])
+			}
+			openControl = controlStack[len(controlStack)-1]
+
+			i = endOpenIfIndex + 1
+		} else if strings.HasPrefix(markup[i:], "{for ") {
+			startOpenForIndex := i
+			endOpenForIndex := findTagEnd(markup, startOpenForIndex)
+			if endOpenForIndex == -1 {
+				return nil, markupErrorf(startOpenForIndex, "{for } loop missing closing \"}\"")
+			}
+
+			newControl, err := parseForHeader(markup[startOpenForIndex+len("{for ") : endOpenForIndex])
+			if err != nil {
+				return nil, markupErrorf(startOpenForIndex, "{for } loop %s", err)
+			}
+			newControl.index = startOpenForIndex
+			if openControl != nil {
+				openControl.children = append(openControl.children, newControl)
+				controlStack = append(controlStack, &openControl.children[len(openControl.children)-1])
+			} else {
+				controlTree = append(controlTree, newControl)
+				controlStack = append(controlStack, &controlTree[len(controlTree)-1])
+			}
+			openControl = controlStack[len(controlStack)-1]
+
+			i = endOpenForIndex + 1
+		} else if strings.HasPrefix(markup[i:], "{else if ") {
+			if openControl == nil {
+				return nil, markupErrorf(i, "{else if} missing opening {if}")
+			}
+			startElseIfIndex := i
+
+			relativeEndElseIfIndex := strings.Index(markup[startElseIfIndex:], "}")
+			if relativeEndElseIfIndex == -1 {
+				return nil, markupErrorf(startElseIfIndex, "{else if} condition missing closing \"}\"")
+			}
+			endElseIfIndex := startElseIfIndex + relativeEndElseIfIndex
+
+			elseIfCondition := markup[startElseIfIndex+len("{else if ") : endElseIfIndex]
+
+			if openControl.isElseIfStmt {
+				controlStack = controlStack[:len(controlStack)-1] // Pop from stack
 				openControl = controlStack[len(controlStack)-1]
 			}
 
 			openControl.children = append(openControl.children, control{
+				index:           i,
 				isElseIfStmt:    true,
 				elseIfCondition: elseIfCondition,
 			})
@@ -661,9 +2463,10 @@ func buildControlTree(markup string) ([]control, error) {
 			i = endElseIfIndex + 1
 		} else if strings.HasPrefix(markup[i:], "{else}") {
 			if openControl == nil {
-				return nil, fmt.Errorf("{else} at index %d missing opening {if}", i)
+				return nil, markupErrorf(i, "{else} missing opening {if} or {for}")
 			}
 			newControl := control{
+				index:      i,
 				isElseStmt: true,
 			}
 
@@ -676,54 +2479,168 @@ func buildControlTree(markup string) ([]control, error) {
 			openControl = controlStack[len(controlStack)-1]
 
 			i += len("{else}")
-		} else if i+1 < len(markup) && markup[i] == '<' && isUpper(markup[i+1]) {
+		} else if (i+1 < len(markup) && markup[i] == '<' && isUpper(markup[i+1])) || isSelfStart(markup, i) {
 			startCompIndex := i
-			relativeEndCompIndex := strings.Index(markup[startCompIndex:], "/>")
-			if relativeEndCompIndex == -1 {
-				return nil, fmt.Errorf("Component missing closing \"/>\" at index %d", startCompIndex)
+			endCompIndex := findElementEnd(markup, startCompIndex)
+			if endCompIndex == -1 {
+				return nil, markupErrorf(startCompIndex, "Component missing closing \">\"")
 			}
-			endCompIndex := startCompIndex + relativeEndCompIndex
+			selfClosing := markup[endCompIndex-1] == '/'
 
 			startCompNameIndex := i + 1
-			relativeEndCompNameIndex := strings.Index(markup[startCompNameIndex:], " ")
+			relativeEndCompNameIndex := strings.IndexAny(markup[startCompNameIndex:endCompIndex+1], " \t\n/>"+string(trimmedChar))
 			endCompNameIndex := startCompNameIndex + relativeEndCompNameIndex
 
 			compName := markup[startCompNameIndex:endCompNameIndex]
-			compProps := markup[endCompNameIndex+1 : endCompIndex]
+			if compName == "self" {
+				compName = "Self"
+			}
+			endCompAttrsIndex := endCompIndex
+			if selfClosing {
+				endCompAttrsIndex--
+			}
+			attrs, err := parseCompAttrs(markup, endCompNameIndex, endCompAttrsIndex)
+			if err != nil {
+				return nil, err
+			}
 
 			newControl := control{
-				isComp:    true,
-				compName:  compName,
-				compProps: getCompArgs(compProps),
+				index:       i,
+				isComp:      true,
+				compName:    compName,
+				compProps:   attrs.props,
+				compSpreads: attrs.spreads,
+				compEvents:  attrs.events,
+				compClient:  attrs.client,
+				slotLets:    attrs.lets,
+				slotMarkup:  markup,
+				slotStart:   endCompIndex + 1,
+				slotEnd:     endCompIndex + 1,
+			}
+
+			if openControl != nil {
+				openControl.children = append(openControl.children, newControl)
+				if !selfClosing {
+					controlStack = append(controlStack, &openControl.children[len(openControl.children)-1])
+				}
+			} else {
+				controlTree = append(controlTree, newControl)
+				if !selfClosing {
+					controlStack = append(controlStack, &controlTree[len(controlTree)-1])
+				}
+			}
+			if !selfClosing {
+				// Everything up to the closing tag is passed to the component's <slot />
+				openControl = controlStack[len(controlStack)-1]
+			}
+
+			i = endCompIndex + 1
+		} else if (i+2 < len(markup) && strings.HasPrefix(markup[i:], "</") && isUpper(markup[i+2])) || strings.HasPrefix(markup[i:], "</self>") {
+			relativeEndCloseCompIndex := strings.IndexRune(markup[i:], '>')
+			if relativeEndCloseCompIndex == -1 {
+				return nil, markupErrorf(i, "closing component tag missing \">\"")
+			}
+			endCloseCompIndex := i + relativeEndCloseCompIndex
+			compName := strings.TrimSpace(markup[i+len("</") : endCloseCompIndex])
+			if compName == "self" {
+				compName = "Self"
+			}
+			if openControl == nil || !openControl.isComp || openControl.compName != compName {
+				return nil, markupErrorf(i, "closing </%s> without opening <%s>", compName, compName)
+			}
+			openControl.slotEnd = i
+			controlStack = controlStack[:len(controlStack)-1] // Pop from stack
+			if len(controlStack) > 0 {
+				openControl = controlStack[len(controlStack)-1]
+			} else {
+				openControl = nil
+			}
+			i = endCloseCompIndex + 1
+		} else if isSlotStart(markup, i) {
+			startSlotIndex := i
+			endSlotIndex := findElementEnd(markup, startSlotIndex)
+			if endSlotIndex == -1 {
+				return nil, markupErrorf(startSlotIndex, "<slot> missing closing \">\"")
+			}
+			selfClosing := markup[endSlotIndex-1] == '/'
+
+			endSlotAttrsIndex := endSlotIndex
+			if selfClosing {
+				endSlotAttrsIndex--
+			}
+			attrs, err := parseCompAttrs(markup, startSlotIndex+len("<slot"), endSlotAttrsIndex)
+			if err != nil {
+				return nil, err
+			}
+			slotName := ""
+			if name, ok := attrs.props["name"]; ok {
+				// Slots are matched by name when the tree is built, so it can't be an expression
+				if err := json.Unmarshal([]byte(name.(string)), &slotName); err != nil {
+					return nil, markupErrorf(startSlotIndex, "<slot> name has to be a quoted string")
+				}
+				delete(attrs.props, "name")
 			}
 
-			// TODO: For now Comp won't have children (eventually add slot support)
+			newControl := control{
+				index:     i,
+				isSlot:    true,
+				slotName:  slotName,
+				slotProps: attrs.props,
+			}
 			if openControl != nil {
 				openControl.children = append(openControl.children, newControl)
+				if !selfClosing {
+					controlStack = append(controlStack, &openControl.children[len(openControl.children)-1])
+				}
 			} else {
 				controlTree = append(controlTree, newControl)
+				if !selfClosing {
+					controlStack = append(controlStack, &controlTree[len(controlTree)-1])
+				}
+			}
+			if !selfClosing {
+				// Everything up to </slot> is the fallback for when the parent doesn't fill the slot
+				openControl = controlStack[len(controlStack)-1]
 			}
 
-			i = endCompIndex + len("/>")
+			i = endSlotIndex + 1
+		} else if strings.HasPrefix(markup[i:], "</slot>") {
+			if openControl == nil || !openControl.isSlot {
+				return nil, markupErrorf(i, "closing </slot> without opening <slot>")
+			}
+			controlStack = controlStack[:len(controlStack)-1] // Pop from stack
+			if len(controlStack) > 0 {
+				openControl = controlStack[len(controlStack)-1]
+			} else {
+				openControl = nil
+			}
+			i += len("</slot>")
 		} else if strings.HasPrefix(markup[i:], "<=") {
 			startDynamicCompIndex := i
-			relativeEndDynamicCompIndex := strings.Index(markup[startDynamicCompIndex:], "/>")
-			if relativeEndDynamicCompIndex == -1 {
-				return nil, fmt.Errorf("<= dynamic comp missing closing \"/>\" at index %d", startDynamicCompIndex)
+			endDynamicCompIndex := findElementEnd(markup, startDynamicCompIndex)
+			if endDynamicCompIndex == -1 || markup[endDynamicCompIndex-1] != '/' {
+				return nil, markupErrorf(startDynamicCompIndex, "<= dynamic comp missing closing \"/>\"")
 			}
-			endDynamicCompIndex := startDynamicCompIndex + relativeEndDynamicCompIndex
+			endDynamicCompIndex-- // Point at the "/" of "/>"
 
 			startDynamicCompPathIndex := startDynamicCompIndex + len("<='")
 			// TODO: dynamic paths now need to be wrapped in either single or double quotes
 			relativeEndDynamicCompPathIndex := strings.IndexAny(markup[startDynamicCompPathIndex:], "'\"")
 			endDynamicCompPathIndex := startDynamicCompPathIndex + relativeEndDynamicCompPathIndex
 			dynamicCompPath := markup[startDynamicCompPathIndex:endDynamicCompPathIndex]
-			dynamicCompProps := markup[endDynamicCompPathIndex+1 : endDynamicCompIndex]
+			attrs, err := parseCompAttrs(markup, endDynamicCompPathIndex+1, endDynamicCompIndex)
+			if err != nil {
+				return nil, err
+			}
 
 			newControl := control{
+				index:            i,
 				isDynamicComp:    true,
 				dynamicCompPath:  strings.Trim(dynamicCompPath, "'\""),
-				dynamicCompProps: getCompArgs(dynamicCompProps),
+				dynamicCompProps: attrs.props,
+				compSpreads:      attrs.spreads,
+				compEvents:       attrs.events,
+				compClient:       attrs.client,
 			}
 
 			// TODO: For now dynamicComp won't have children (eventually add slot support)
@@ -734,48 +2651,301 @@ func buildControlTree(markup string) ([]control, error) {
 			}
 
 			i = endDynamicCompIndex + len("/>")
-		} else if strings.HasPrefix(markup[i:], "{/if}") {
-			if openControl == nil {
-				return nil, fmt.Errorf("closing {/if} at index %d without opening {if}", i)
+		} else if strings.HasPrefix(markup[i:], "{switch ") {
+			startSwitchIndex := i
+			endSwitchIndex := findTagEnd(markup, startSwitchIndex)
+			if endSwitchIndex == -1 {
+				return nil, markupErrorf(startSwitchIndex, "{switch} expression missing closing \"}\"")
 			}
-			if openControl.isElseIfStmt || openControl.isElseStmt {
-				controlStack = controlStack[:len(controlStack)-1] // Pop from stack
+
+			newControl := control{
+				index:        i,
+				isSwitchStmt: true,
+				switchExpr:   strings.TrimSpace(markup[startSwitchIndex+len("{switch ") : endSwitchIndex]),
 			}
-			controlStack = controlStack[:len(controlStack)-1] // Pop from stack
-			if len(controlStack) > 0 {
-				openControl = controlStack[len(controlStack)-1]
+			if openControl != nil {
+				openControl.children = append(openControl.children, newControl)
+				controlStack = append(controlStack, &openControl.children[len(openControl.children)-1])
 			} else {
-				openControl = nil
+				controlTree = append(controlTree, newControl)
+				controlStack = append(controlStack, &controlTree[len(controlTree)-1])
 			}
-			i += len("{/if}")
-		} else if strings.HasPrefix(markup[i:], "{/for}") {
-			if openControl == nil {
-				return nil, fmt.Errorf("closing {/for} at index %d without opening {for}", i)
+			openControl = controlStack[len(controlStack)-1]
+
+			i = endSwitchIndex + 1
+		} else if strings.HasPrefix(markup[i:], "{case ") {
+			if openControl == nil || !(openControl.isSwitchStmt || openControl.isCaseStmt || openControl.isDefaultStmt) {
+				return nil, markupErrorf(i, "{case} missing opening {switch}")
 			}
-			controlStack = controlStack[:len(controlStack)-1] // Pop from stack
-			if len(controlStack) > 0 {
-				openControl = controlStack[len(controlStack)-1]
-			} else {
-				openControl = nil
+			if openControl.isDefaultStmt {
+				return nil, markupErrorf(i, "{case} comes after {default}, which must be the last branch of a {switch}")
 			}
-			i += len("{/for}")
-		} else {
-			start := i
-			for i < len(markup) &&
-				!strings.HasPrefix(markup[i:], "<=") &&
-				!(i+1 < len(markup) && markup[i] == '<' && isUpper(markup[i+1])) &&
-				!strings.HasPrefix(markup[i:], "{if ") &&
-				!strings.HasPrefix(markup[i:], "{for ") &&
-				!strings.HasPrefix(markup[i:], "{else if ") &&
-				!strings.HasPrefix(markup[i:], "{else}") &&
-				!strings.HasPrefix(markup[i:], "{/if}") &&
-				!strings.HasPrefix(markup[i:], "{/for}") {
-				i++
+			startCaseIndex := i
+			endCaseIndex := findTagEnd(markup, startCaseIndex)
+			if endCaseIndex == -1 {
+				return nil, markupErrorf(startCaseIndex, "{case} values missing closing \"}\"")
 			}
-			if start < i {
-				newControl := control{
+
+			caseValues := splitTopLevel(markup[startCaseIndex+len("{case "):endCaseIndex], ",")
+
+			if openControl.isCaseStmt {
+				controlStack = controlStack[:len(controlStack)-1] // Pop from stack
+				openControl = controlStack[len(controlStack)-1]
+			}
+			openControl.children = append(openControl.children, control{
+				index:      i,
+				isCaseStmt: true,
+				caseValues: caseValues,
+			})
+			controlStack = append(controlStack, &openControl.children[len(openControl.children)-1])
+			openControl = controlStack[len(controlStack)-1]
+
+			i = endCaseIndex + 1
+		} else if strings.HasPrefix(markup[i:], "{default}") {
+			if openControl == nil || !(openControl.isSwitchStmt || openControl.isCaseStmt || openControl.isDefaultStmt) {
+				return nil, markupErrorf(i, "{default} missing opening {switch}")
+			}
+			if openControl.isDefaultStmt {
+				return nil, markupErrorf(i, "duplicate {default}, a {switch} can only have one")
+			}
+
+			if openControl.isCaseStmt {
+				controlStack = controlStack[:len(controlStack)-1] // Pop from stack
+				openControl = controlStack[len(controlStack)-1]
+			}
+			openControl.children = append(openControl.children, control{
+				index:         i,
+				isDefaultStmt: true,
+			})
+			controlStack = append(controlStack, &openControl.children[len(openControl.children)-1])
+			openControl = controlStack[len(controlStack)-1]
+
+			i += len("{default}")
+		} else if strings.HasPrefix(markup[i:], "{block ") {
+			startBlockIndex := i
+			endBlockIndex := findTagEnd(markup, startBlockIndex)
+			if endBlockIndex == -1 {
+				return nil, markupErrorf(startBlockIndex, "{block} name missing closing \"}\"")
+			}
+			blockName := strings.TrimSpace(markup[startBlockIndex+len("{block ") : endBlockIndex])
+			if !regexp.MustCompile(`^[\w-]+$`).MatchString(blockName) {
+				return nil, markupErrorf(startBlockIndex, "{block %s} name can only have letters, numbers, _ and -", blockName)
+			}
+
+			newControl := control{
+				index:     i,
+				isBlock:   true,
+				blockName: blockName,
+			}
+			if openControl != nil {
+				openControl.children = append(openControl.children, newControl)
+				controlStack = append(controlStack, &openControl.children[len(openControl.children)-1])
+			} else {
+				controlTree = append(controlTree, newControl)
+				controlStack = append(controlStack, &controlTree[len(controlTree)-1])
+			}
+			openControl = controlStack[len(controlStack)-1]
+
+			i = endBlockIndex + 1
+		} else if strings.HasPrefix(markup[i:], "{/block}") {
+			if openControl == nil || !openControl.isBlock {
+				return nil, markupErrorf(i, "closing {/block} without opening {block}")
+			}
+			controlStack = controlStack[:len(controlStack)-1] // Pop from stack
+			if len(controlStack) > 0 {
+				openControl = controlStack[len(controlStack)-1]
+			} else {
+				openControl = nil
+			}
+			i += len("{/block}")
+		} else if strings.HasPrefix(markup[i:], "{/switch}") {
+			if openControl == nil || !(openControl.isSwitchStmt || openControl.isCaseStmt || openControl.isDefaultStmt) {
+				return nil, markupErrorf(i, "closing {/switch} without opening {switch}")
+			}
+			if openControl.isCaseStmt || openControl.isDefaultStmt {
+				controlStack = controlStack[:len(controlStack)-1] // Pop from stack
+			}
+			controlStack = controlStack[:len(controlStack)-1] // Pop from stack
+			if len(controlStack) > 0 {
+				openControl = controlStack[len(controlStack)-1]
+			} else {
+				openControl = nil
+			}
+			i += len("{/switch}")
+		} else if strings.HasPrefix(markup[i:], "{await ") {
+			startAwaitIndex := i
+			endAwaitIndex := findTagEnd(markup, startAwaitIndex)
+			if endAwaitIndex == -1 {
+				return nil, markupErrorf(startAwaitIndex, "{await} promise missing closing \"}\"")
+			}
+
+			awaitExpr := strings.TrimSpace(markup[startAwaitIndex+len("{await ") : endAwaitIndex])
+			clientOnly := strings.HasSuffix(awaitExpr, " client:only")
+			newControl := control{
+				index:           i,
+				isAwaitBlock:    true,
+				awaitExpr:       strings.TrimSpace(strings.TrimSuffix(awaitExpr, " client:only")),
+				awaitClientOnly: clientOnly,
+			}
+			if openControl != nil {
+				openControl.children = append(openControl.children, newControl)
+				controlStack = append(controlStack, &openControl.children[len(openControl.children)-1])
+			} else {
+				controlTree = append(controlTree, newControl)
+				controlStack = append(controlStack, &controlTree[len(controlTree)-1])
+			}
+			openControl = controlStack[len(controlStack)-1]
+
+			i = endAwaitIndex + 1
+		} else if strings.HasPrefix(markup[i:], "{then}") || strings.HasPrefix(markup[i:], "{then ") ||
+			strings.HasPrefix(markup[i:], "{catch}") || strings.HasPrefix(markup[i:], "{catch ") {
+			if openControl == nil || !(openControl.isAwaitBlock || openControl.isThenStmt || openControl.isCatchStmt) {
+				return nil, markupErrorf(i, "{then} or {catch} missing opening {await}")
+			}
+			startBranchIndex := i
+			endBranchIndex := findTagEnd(markup, startBranchIndex)
+			if endBranchIndex == -1 {
+				return nil, markupErrorf(startBranchIndex, "{then} or {catch} missing closing \"}\"")
+			}
+
+			newControl := control{index: i}
+			if strings.HasPrefix(markup[i:], "{then") {
+				newControl.isThenStmt = true
+				newControl.awaitVar = strings.TrimSpace(markup[startBranchIndex+len("{then") : endBranchIndex])
+			} else {
+				newControl.isCatchStmt = true
+				newControl.awaitVar = strings.TrimSpace(markup[startBranchIndex+len("{catch") : endBranchIndex])
+			}
+
+			if openControl.isThenStmt || openControl.isCatchStmt {
+				controlStack = controlStack[:len(controlStack)-1] // Pop from stack
+				openControl = controlStack[len(controlStack)-1]
+			}
+			openControl.children = append(openControl.children, newControl)
+			controlStack = append(controlStack, &openControl.children[len(openControl.children)-1])
+			openControl = controlStack[len(controlStack)-1]
+
+			i = endBranchIndex + 1
+		} else if strings.HasPrefix(markup[i:], "{/await}") {
+			if openControl == nil || !(openControl.isAwaitBlock || openControl.isThenStmt || openControl.isCatchStmt) {
+				return nil, markupErrorf(i, "closing {/await} without opening {await}")
+			}
+			if openControl.isThenStmt || openControl.isCatchStmt {
+				controlStack = controlStack[:len(controlStack)-1] // Pop from stack
+			}
+			controlStack = controlStack[:len(controlStack)-1] // Pop from stack
+			if len(controlStack) > 0 {
+				openControl = controlStack[len(controlStack)-1]
+			} else {
+				openControl = nil
+			}
+			i += len("{/await}")
+		} else if strings.HasPrefix(markup[i:], "{const ") || strings.HasPrefix(markup[i:], "{let ") {
+			startBindingIndex := i
+			keyword := markup[i+1 : i+strings.IndexRune(markup[i:], ' ')]
+			endBindingIndex := findTagEnd(markup, startBindingIndex)
+			if endBindingIndex == -1 {
+				return nil, markupErrorf(startBindingIndex, "{%s} binding missing closing \"}\"", keyword)
+			}
+
+			declaration := markup[startBindingIndex+1 : endBindingIndex]
+			declaration = declaration[strings.IndexRune(declaration, ' ')+1:]
+			assignIndex := indexTopLevel(declaration, "=")
+			if assignIndex == -1 {
+				return nil, markupErrorf(startBindingIndex, "{%s} binding missing \"= value\"", keyword)
+			}
+			bindingPattern := strings.TrimSpace(declaration[:assignIndex])
+			if getBindingNames(bindingPattern) == nil {
+				return nil, markupErrorf(startBindingIndex, "{%s} binding has invalid name %q", keyword, bindingPattern)
+			}
+
+			newControl := control{
+				index:          i,
+				isBinding:      true,
+				bindingKeyword: keyword,
+				bindingPattern: bindingPattern,
+				bindingExpr:    strings.TrimSpace(declaration[assignIndex+1:]),
+			}
+			// Bindings don't have children, they apply to the nodes that follow them
+			if openControl != nil {
+				openControl.children = append(openControl.children, newControl)
+			} else {
+				controlTree = append(controlTree, newControl)
+			}
+
+			i = endBindingIndex + 1
+		} else if strings.HasPrefix(markup[i:], "{@html ") {
+			startRawIndex := i
+			endRawIndex := findTagEnd(markup, startRawIndex)
+			if endRawIndex == -1 {
+				return nil, markupErrorf(startRawIndex, "{@html} expression missing closing \"}\"")
+			}
+
+			newControl := control{
+				index:       i,
+				isRawHTML:   true,
+				rawHTMLExpr: strings.TrimSpace(markup[startRawIndex+len("{@html ") : endRawIndex]),
+			}
+			if openControl != nil {
+				openControl.children = append(openControl.children, newControl)
+			} else {
+				controlTree = append(controlTree, newControl)
+			}
+
+			i = endRawIndex + 1
+		} else if strings.HasPrefix(markup[i:], "{!--") {
+			// Template comments never reach the output, skip everything up to the closing --}
+			relativeEndCommentIndex := strings.Index(markup[i:], "--}")
+			if relativeEndCommentIndex == -1 {
+				return nil, markupErrorf(i, "{!-- comment missing closing \"--}\"")
+			}
+			i += relativeEndCommentIndex + len("--}")
+		} else if strings.HasPrefix(markup[i:], "{/if}") {
+			if openControl == nil {
+				return nil, markupErrorf(i, "closing {/if} without opening {if}")
+			}
+			if openControl.isElseIfStmt || openControl.isElseStmt {
+				controlStack = controlStack[:len(controlStack)-1] // Pop from stack
+			}
+			controlStack = controlStack[:len(controlStack)-1] // Pop from stack
+			if len(controlStack) > 0 {
+				openControl = controlStack[len(controlStack)-1]
+			} else {
+				openControl = nil
+			}
+			i += len("{/if}")
+		} else if strings.HasPrefix(markup[i:], "{/for}") {
+			if openControl == nil {
+				return nil, markupErrorf(i, "closing {/for} without opening {for}")
+			}
+			if openControl.isElseStmt {
+				controlStack = controlStack[:len(controlStack)-1] // Pop from stack
+			}
+			controlStack = controlStack[:len(controlStack)-1] // Pop from stack
+			if len(controlStack) > 0 {
+				openControl = controlStack[len(controlStack)-1]
+			} else {
+				openControl = nil
+			}
+			i += len("{/for}")
+		} else {
+			start := i
+			for i < len(markup) && !isControlStart(markup, i) {
+				i++
+			}
+			textContent := bindSpreads(strings.ReplaceAll(markup[start:i], string(trimmedChar), ""))
+			if textContent != "" {
+				newControl := control{
+					index:       start,
 					isTextNode:  true,
-					textContent: markup[start:i],
+					textContent: textContent,
+				}
+				if openControl != nil && openControl.isSwitchStmt {
+					// Only {case} and {default} branches can render inside a {switch}
+					if strings.TrimSpace(newControl.textContent) != "" {
+						return nil, markupErrorf(start, "content must be inside a {case} or {default} branch")
+					}
+					continue
 				}
 				if openControl != nil {
 					openControl.children = append(openControl.children, newControl)
@@ -788,188 +2958,1568 @@ func buildControlTree(markup string) ([]control, error) {
 		}
 	}
 
-	return controlTree, nil
+	if len(controlStack) > 0 {
+		return nil, markupErrorf(controlStack[len(controlStack)-1].index, "block is never closed")
+	}
+
+	return controlTree, nil
+}
+
+type scopeStackItem struct {
+	scopedElements []scopedElement
+	style          string
+	script         string
+}
+
+type fragmentToken struct {
+	token html.Token
+	raw   string // Used as-is when the token hasn't been modified
+}
+
+// addXDataAttribute adds x-data="" to all top-level HTML elements
+// and evaluates the brackets inside them with the given props.
+// It tokenizes instead of parsing a tree so fragments that close elements
+// opened elsewhere in the template (e.g. the rest of a block after a {const}) survive
+func addXDataAttribute(htmlStr string, dataStr string, attrs []html.Attribute, props map[string]any) (string, error) {
+	tokens := []fragmentToken{}
+	openTags := []int{} // Indexes of start tags that haven't been closed yet
+	rawText := ""       // The <script> or <style> the text is inside
+	inRawHTML := false  // Inside {@html} output
+	rawParents := map[int]bool{}
+	xTexts := map[int][]html.Attribute{}
+
+	z := html.NewTokenizer(strings.NewReader(htmlStr))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() == io.EOF {
+				break
+			}
+			return "", fmt.Errorf("failed to parse HTML: %w", z.Err())
+		}
+		raw := string(z.Raw())
+		token := z.Token()
+		if tt == html.CommentToken && (token.Data == "@html" || token.Data == "/@html") {
+			inRawHTML = token.Data == "@html"
+			if inRawHTML && len(openTags) > 0 {
+				rawParents[openTags[len(openTags)-1]] = true
+			}
+		}
+		if tt == html.CommentToken && isPlaceholderComment(token.Data) && len(openTags) > 0 {
+			// The slot or block gets filled in later, so the parent can't be replaced with its fallback text
+			rawParents[openTags[len(openTags)-1]] = true
+		}
+		if inRawHTML {
+			// Leave {@html} output exactly as it was given
+			tokens = append(tokens, fragmentToken{token: token, raw: raw})
+			continue
+		}
+		switch tt {
+		case html.StartTagToken, html.SelfClosingTagToken:
+			if len(openTags) == 0 {
+				// Add x-data="" to top-level elements, merging with the x-data they already have
+				hasXData := false
+				for i, attr := range token.Attr {
+					if attr.Key == "x-data" {
+						hasXData = true
+						token.Attr[i].Val = mergeXData(dataStr, attr.Val)
+						break
+					}
+				}
+				if !hasXData && dataStr != "" {
+					token.Attr = append(token.Attr, html.Attribute{Key: "x-data", Val: dataStr})
+				}
+				for _, attr := range attrs {
+					token.Attr = mergeAttr(token.Attr, attr)
+				}
+			}
+			hydrated, err := hydrateAttrs(token.Attr, props)
+			if err != nil && !inTemplateTag(tokens, openTags) {
+				return "", err
+			}
+			token.Attr = hydrated
+			raw = ""
+			if tt == html.StartTagToken && !voidElements[token.Data] {
+				openTags = append(openTags, len(tokens))
+				if token.Data == "script" || token.Data == "style" {
+					rawText = token.Data
+				}
+			}
+		case html.EndTagToken:
+			rawText = ""
+			for i := len(openTags) - 1; i >= 0; i-- {
+				if tokens[openTags[i]].token.Data == token.Data {
+					openTags = openTags[:i] // Pop the element and anything left unclosed inside it
+					break
+				}
+			}
+		case html.TextToken:
+			if rawText == "script" && strings.Contains(token.Data, "{") && strings.Contains(token.Data, "}") && !inTemplateTag(tokens, openTags) {
+				// Only rendered at build time, Alpine's x-text wouldn't run the script again
+				evaluated, err := escapeBrackets(token.Data, props, "script")
+				if err != nil {
+					return "", err
+				}
+				// Script isn't HTML escaped, the JSON values already can't close it
+				token.Data = evaluated
+				raw = evaluated
+			} else if rawText == "" && strings.Contains(token.Data, "{") && strings.Contains(token.Data, "}") {
+				// Evaluate the brackets now, while the loop variables are still in scope
+				evaluated, xText, err := hydrateText(token.Data, props)
+				if err != nil && !inTemplateTag(tokens, openTags) {
+					return "", err
+				}
+				if xText != nil && len(openTags) > 0 {
+					parent := openTags[len(openTags)-1]
+					xTexts[parent] = append(xTexts[parent], *xText)
+				}
+				token.Data = evaluated
+				raw = ""
+			}
+		}
+		tokens = append(tokens, fragmentToken{token: token, raw: raw})
+	}
+
+	// Add the x-text bindings, unless they would wipe out {@html} output on the client
+	for i, attrs := range xTexts {
+		if !rawParents[i] {
+			tokens[i].token.Attr = append(tokens[i].token.Attr, attrs...)
+			tokens[i].raw = ""
+		}
+	}
+
+	// Render the modified HTML
+	var buf strings.Builder
+	for _, t := range tokens {
+		if t.raw != "" {
+			buf.WriteString(t.raw)
+		} else {
+			buf.WriteString(t.token.String())
+		}
+	}
+
+	return buf.String(), nil
+}
+
+// openElementStart returns the index of the start tag of the innermost element
+// that's still open at the end of markup, or -1 if they're all closed
+func openElementStart(markup string) int {
+	type openTag struct {
+		name  string
+		start int
+	}
+	open := []openTag{}
+	offset := 0
+	z := html.NewTokenizer(strings.NewReader(markup))
+	for tt := z.Next(); tt != html.ErrorToken; tt = z.Next() {
+		size := len(z.Raw())
+		name, _ := z.TagName()
+		if tt == html.StartTagToken && !voidElements[string(name)] {
+			open = append(open, openTag{name: string(name), start: offset})
+		} else if tt == html.EndTagToken {
+			for i := len(open) - 1; i >= 0; i-- {
+				if open[i].name == string(name) {
+					open = open[:i]
+					break
+				}
+			}
+		}
+		offset += size
+	}
+	if len(open) == 0 {
+		return -1
+	}
+	return open[len(open)-1].start
+}
+
+// closesOuterElement checks if markup has an end tag for an element that was opened before it
+func closesOuterElement(markup string) bool {
+	open := []string{}
+	z := html.NewTokenizer(strings.NewReader(markup))
+	for tt := z.Next(); tt != html.ErrorToken; tt = z.Next() {
+		name, _ := z.TagName()
+		if tt == html.StartTagToken && !voidElements[string(name)] {
+			open = append(open, string(name))
+		} else if tt == html.EndTagToken {
+			i := len(open) - 1
+			for i >= 0 && open[i] != string(name) {
+				i--
+			}
+			if i == -1 {
+				return true
+			}
+			open = open[:i]
+		}
+	}
+	return false
+}
+
+// inTemplateTag checks if any of the open tags is a <template>, like inTemplate does for parsed nodes
+func inTemplateTag(tokens []fragmentToken, openTags []int) bool {
+	for _, i := range openTags {
+		if tokens[i].token.Data == "template" {
+			return true
+		}
+	}
+	return false
+}
+
+// voidElements can't have children, so they never need a closing tag
+var voidElements = map[string]bool{
+	"area": true, "base": true, "br": true, "col": true, "embed": true, "hr": true, "img": true,
+	"input": true, "link": true, "meta": true, "param": true, "source": true, "track": true, "wbr": true,
+}
+
+// mergeXData combines an outer x-data object with the x-data already on an element,
+// keeping the element's own values when both declare the same name
+func mergeXData(outer string, inner string) string {
+	outer = strings.TrimSpace(outer)
+	inner = strings.TrimSpace(inner)
+	if !strings.HasPrefix(outer, "{") || !strings.HasSuffix(outer, "}") {
+		return inner
+	}
+	if !strings.HasPrefix(inner, "{") || !strings.HasSuffix(inner, "}") {
+		return inner
+	}
+	outerFields := strings.TrimSpace(outer[1 : len(outer)-1])
+	innerFields := strings.TrimSpace(inner[1 : len(inner)-1])
+	if outerFields == "" {
+		return inner
+	}
+	if innerFields == "" {
+		return outer
+	}
+	return "{" + outerFields + ", " + innerFields + "}"
+}
+
+// mergeAttr adds attr to attrs, combining it with an existing style instead of duplicating it
+func mergeAttr(attrs []html.Attribute, attr html.Attribute) []html.Attribute {
+	for i, existing := range attrs {
+		if existing.Key == attr.Key && attr.Key == "style" {
+			attrs[i].Val = attr.Val + " " + existing.Val
+			return attrs
+		}
+	}
+	return append(attrs, attr)
+}
+
+// getElseBranch returns the {else} fallback of a {for} loop, if it has one
+func getElseBranch(ctrl control) *control {
+	for i, child := range ctrl.children {
+		if child.isElseStmt {
+			return &ctrl.children[i]
+		}
+	}
+	return nil
+}
+
+// evalClientAwait renders the pending branch of a client:only {await} block and
+// ships the {then} and {catch} branches as templates that Alpine shows once the promise settles
+func evalClientAwait(ctrl control, props map[string]any, frame *renderFrame) (string, error) {
+	var markupBuilder strings.Builder
+	markupBuilder.WriteString(fmt.Sprintf(`<div style="display: contents" x-data="{_plenti_await: {state: 'pending', value: undefined}}" x-init="%s">`,
+		makeExprAttr(fmt.Sprintf("Promise.resolve(%s).then(value => _plenti_await = {state: 'then', value}, value => _plenti_await = {state: 'catch', value})", ctrl.awaitExpr))))
+
+	markup, err := evalControlTree(getPendingChildren(ctrl), props, frame)
+	if err != nil {
+		return "", err
+	}
+	markup, err = addXDataAttribute(markup, "", []html.Attribute{{Key: "x-show", Val: "_plenti_await.state === 'pending'"}}, props)
+	if err != nil {
+		return "", err
+	}
+	markupBuilder.WriteString(markup)
+
+	for _, kind := range []string{"then", "catch"} {
+		branch := getAwaitBranch(ctrl, kind)
+		if branch == nil {
+			continue
+		}
+		// The value only exists in the browser, so it's undefined while rendering the branch at build time
+		newProps := props
+		dataStr := ""
+		if branch.awaitVar != "" {
+			newProps = make(map[string]any)
+			for k, v := range props {
+				newProps[k] = v
+			}
+			newProps[branch.awaitVar] = nil
+			dataStr = fmt.Sprintf("{%s: _plenti_await.value}", branch.awaitVar)
+		}
+		markup, err := evalControlTree(branch.children, newProps, frame)
+		if err != nil {
+			return "", err
+		}
+		markupBuilder.WriteString(fmt.Sprintf(`<template x-if="_plenti_await.state === '%s'"><div style="display: contents" x-data="%s">%s</div></template>`, kind, dataStr, markup))
+	}
+	markupBuilder.WriteString("</div>")
+
+	return markupBuilder.String(), nil
+}
+
+func evalControlTree(controlTree []control, props map[string]any, frame *renderFrame) (string, error) {
+	var markupBuilder strings.Builder
+
+	for i, ctrl := range controlTree {
+		if ctrl.isTextNode {
+			markupBuilder.WriteString(ctrl.textContent)
+		} else if ctrl.isBinding {
+			bindings, err := evalBinding(ctrl, props)
+			if err != nil {
+				return "", errorAt(ctrl.index, err)
+			}
+			newProps := make(map[string]any)
+			for k, v := range props {
+				newProps[k] = v
+			}
+			for k, v := range bindings {
+				newProps[k] = v
+			}
+			// The binding is in scope for the rest of the siblings and their children
+			markup, err := evalControlTree(controlTree[i+1:], newProps, frame)
+			if err != nil {
+				return "", errorAt(ctrl.index, err)
+			}
+			if closesOuterElement(markup) {
+				// The binding is inside an element that was opened before it, so that element
+				// gets the binding in its x-data and the x-text for what uses it
+				prefix := markupBuilder.String()
+				start := openElementStart(prefix)
+				if start == -1 {
+					return "", markupErrorf(ctrl.index, "{%s} is inside an element that's opened outside of its block, move it into the block with the element's start tag", ctrl.bindingKeyword)
+				}
+				markupBuilder.Reset()
+				markupBuilder.WriteString(prefix[:start])
+				markup = prefix[start:] + markup
+			}
+			markup, err = addXDataAttribute(markup, makeAttrStr(anyToString(bindings)), nil, newProps)
+			if err != nil {
+				return "", errorAt(ctrl.index, err)
+			}
+			markupBuilder.WriteString(markup)
+			break
+		} else if ctrl.isSlot {
+			// Filled in with the content passed by the parent once the component is rendered,
+			// the fallback stays if the parent doesn't pass any
+			slotProps := map[string]any{}
+			for prop_name, prop_value := range ctrl.slotProps {
+				// Wrapped so object literals like data={{a: 1}} aren't run as a block
+				value, err := evalJS(fmt.Sprintf(`(%s)`, prop_value), props)
+				if err != nil {
+					return "", errorAt(ctrl.index, err)
+				}
+				slotProps[prop_name] = value
+			}
+			fallback, err := evalControlTree(ctrl.children, props, frame)
+			if err != nil {
+				return "", errorAt(ctrl.index, err)
+			}
+			markupBuilder.WriteString(makeSlotPlaceholder(ctrl.slotName, slotProps, frame.state) + fallback + slotPlaceholderEnd)
+		} else if ctrl.isBlock {
+			// Filled in by the template extending this one, the content here stays if it doesn't
+			fallback, err := evalControlTree(ctrl.children, props, frame)
+			if err != nil {
+				return "", errorAt(ctrl.index, err)
+			}
+			markupBuilder.WriteString(blockPlaceholderStart + ctrl.blockName + "-->" + fallback + blockPlaceholderEnd)
+		} else if ctrl.isRawHTML {
+			// The only place values are output without escaping, keep these easy to audit
+			value, err := evalJS(ctrl.rawHTMLExpr, props)
+			if err != nil {
+				return "", errorAt(ctrl.index, err)
+			}
+			markupBuilder.WriteString(rawHTMLStart + fmt.Sprintf("%v", value) + rawHTMLEnd)
+		} else if ctrl.isIfStmt {
+			condition, err := evalJS(ctrl.ifCondition, props)
+			if err != nil {
+				return "", errorAt(ctrl.index, err)
+			}
+			if isBoolAndTrue(condition) {
+				markup, err := evalControlTree(ctrl.children, props, frame)
+				if err != nil {
+					return "", errorAt(ctrl.index, err)
+				}
+				markupBuilder.WriteString(markup)
+			} else {
+				evaluated := false
+				// Process else-if statements
+				for _, child := range ctrl.children {
+					if !child.isElseIfStmt {
+						continue
+					}
+					condition, err := evalJS(child.elseIfCondition, props)
+					if err != nil {
+						return "", errorAt(child.index, err)
+					}
+					if isBoolAndTrue(condition) {
+						markup, err := evalControlTree(child.children, props, frame)
+						if err != nil {
+							return "", errorAt(ctrl.index, err)
+						}
+						markupBuilder.WriteString(markup)
+						evaluated = true
+						break
+					}
+				}
+				// Process else statement if no else-if was true
+				if !evaluated {
+					for _, child := range ctrl.children {
+						if child.isElseStmt {
+							markup, err := evalControlTree(child.children, props, frame)
+							if err != nil {
+								return "", errorAt(ctrl.index, err)
+							}
+							markupBuilder.WriteString(markup)
+							break
+						}
+					}
+				}
+			}
+		} else if ctrl.isForLoop {
+			iterations, err := evalForLoop(ctrl, props)
+			if err != nil {
+				return "", errorAt(ctrl.index, err)
+			}
+			elseBranch := getElseBranch(ctrl)
+			// Loops with a key or an {else} are rendered again by Alpine, so they keep up when the collection changes
+			clientLoop := ctrl.forKey != "" || elseBranch != nil
+			if clientLoop {
+				markupBuilder.WriteString(forItemsStart)
+			}
+			keys := map[string]bool{}
+			for _, iteration := range iterations {
+				newProps := make(map[string]any)
+				for k, v := range props {
+					newProps[k] = v
+				}
+				for k, v := range iteration.bindings {
+					newProps[k] = v
+				}
+				markup, err := evalControlTree(ctrl.children, newProps, frame)
+				if err != nil {
+					return "", errorAt(ctrl.index, err)
+				}
+				if ctrl.forKey != "" {
+					// Alpine matches items up by key when the list changes, so two items can't share one
+					key := anyToString(iteration.key)
+					if keys[key] {
+						return "", markupErrorf(ctrl.index, "{for} loop has more than one item with the key %s", key)
+					}
+					keys[key] = true
+				}
+				dataStr := makeAttrStr(anyToString(iteration.bindings))
+				markup, err = addXDataAttribute(markup, dataStr, nil, newProps)
+				if err != nil {
+					return "", errorAt(ctrl.index, err)
+				}
+				markupBuilder.WriteString(markup)
+			}
+			if elseBranch != nil && len(iterations) == 0 {
+				markup, err := evalControlTree(elseBranch.children, props, frame)
+				if err != nil {
+					return "", errorAt(ctrl.index, err)
+				}
+				markup, err = addXDataAttribute(markup, "", nil, props)
+				if err != nil {
+					return "", errorAt(ctrl.index, err)
+				}
+				markupBuilder.WriteString(markup)
+			}
+			if clientLoop {
+				// What's rendered here gets swapped for Alpine's x-for once the page loads, with the
+				// {else} in an x-if next to it. They're <template>s, so they can go in a <ul> or <tbody>
+				where := "a keyed {for} loop"
+				if ctrl.forKey == "" {
+					where = "a {for} loop with an {else}"
+				}
+				attrs, collection := clientForAttrs(ctrl)
+				attrs = append(attrs, html.Attribute{Key: "x-init", Val: removeForItems})
+				markup, err := clientBranch(attrs, ctrl.children, where)
+				if err == nil && elseBranch != nil {
+					var elseMarkup string
+					elseMarkup, err = clientBranch([]html.Attribute{{Key: "x-if", Val: collection + ".length === 0"}}, elseBranch.children, where)
+					markup += elseMarkup
+				}
+				if err == nil {
+					markup, err = bindClientText(markup)
+				}
+				if err != nil {
+					return "", errorAt(ctrl.index, err)
+				}
+				markupBuilder.WriteString(markup)
+			}
+		} else if ctrl.isSwitchStmt {
+			branch, err := evalSwitch(ctrl, props)
+			if err != nil {
+				return "", errorAt(ctrl.index, err)
+			}
+			if branch != nil {
+				markup, err := evalControlTree(branch.children, props, frame)
+				if err != nil {
+					return "", errorAt(ctrl.index, err)
+				}
+				markupBuilder.WriteString(markup)
+			}
+		} else if ctrl.isAwaitBlock && ctrl.awaitClientOnly {
+			markup, err := evalClientAwait(ctrl, props, frame)
+			if err != nil {
+				return "", errorAt(ctrl.index, err)
+			}
+			markupBuilder.WriteString(markup)
+		} else if ctrl.isAwaitBlock {
+			branch, value, err := evalAwait(ctrl, props)
+			if err != nil {
+				return "", errorAt(ctrl.index, err)
+			}
+			if branch != nil {
+				newProps := props
+				dataStr := ""
+				if branch.awaitVar != "" {
+					newProps = make(map[string]any)
+					for k, v := range props {
+						newProps[k] = v
+					}
+					newProps[branch.awaitVar] = value
+					dataStr = makeAttrStr(anyToString(map[string]any{branch.awaitVar: value}))
+				}
+				markup, err := evalControlTree(branch.children, newProps, frame)
+				if err != nil {
+					return "", errorAt(ctrl.index, err)
+				}
+				markup, err = addXDataAttribute(markup, dataStr, nil, newProps)
+				if err != nil {
+					return "", errorAt(ctrl.index, err)
+				}
+				markupBuilder.WriteString(markup)
+			}
+		} else if ctrl.isComp {
+			newProps, compProps, err := evalCompProps(ctrl.compSpreads, ctrl.compProps, props)
+			if err != nil {
+				return "", errorAt(ctrl.index, err)
+			}
+			var compPath string
+			var ambiguous []string
+			for _, comp := range frame.components {
+				if comp.Name == ctrl.compName {
+					compPath = comp.Path
+					ambiguous = comp.Ambiguous
+				}
+			}
+			if ctrl.compName == "Self" {
+				// <Self> is the template it's written in, which is the last one in the chain
+				compPath = frame.chain[len(frame.chain)-1]
+				ambiguous = nil
+			}
+			if ambiguous != nil {
+				return "", markupErrorf(ctrl.index, "<%s /> is ambiguous, it could be %s; import the one you want in the fence", ctrl.compName, strings.Join(ambiguous, " or "))
+			}
+			if compPath == "" {
+				return "", markupErrorf(ctrl.index, "<%s /> isn't imported in the fence", ctrl.compName)
+			}
+			markup, err := renderComp(ctrl, compPath, newProps, compProps, frame)
+			if err != nil {
+				return "", errorAt(ctrl.index, err)
+			}
+			// Slot content belongs to this template, so it's rendered with its props
+			markup, err = fillSlots(markup, ctrl, props, frame)
+			if err != nil {
+				return "", errorAt(ctrl.index, err)
+			}
+			markupBuilder.WriteString(markup)
+		} else if ctrl.isDynamicComp {
+			newProps, compProps, err := evalCompProps(ctrl.compSpreads, ctrl.dynamicCompProps, props)
+			if err != nil {
+				return "", errorAt(ctrl.index, err)
+			}
+			evaluatedCompPath, err := evalAllBrackets(ctrl.dynamicCompPath, props)
+			if err != nil {
+				return "", errorAt(ctrl.index, err)
+			}
+			// The path can come from props, so it can't be trusted to stay in the project
+			evaluatedCompPath, err = resolveDynamicPath(evaluatedCompPath, frame.state.config)
+			if err != nil {
+				return "", errorAt(ctrl.index, err)
+			}
+			markup, err := renderComp(ctrl, evaluatedCompPath, newProps, compProps, frame)
+			if err != nil {
+				return "", errorAt(ctrl.index, err)
+			}
+			markup, err = fillSlots(markup, ctrl, props, frame)
+			if err != nil {
+				return "", errorAt(ctrl.index, err)
+			}
+			markupBuilder.WriteString(markup)
+		}
+	}
+
+	return markupBuilder.String(), nil
+}
+
+// evalCompProps evaluates the props passed to a component within the context of the parent comp.
+// Spreads are applied in order before the props passed by name, so the named props win.
+// It also returns the expression for each prop, which the client uses to keep them in sync
+func evalCompProps(spreads []string, compProps map[string]any, props map[string]any) (map[string]any, map[string]any, error) {
+	newProps := make(map[string]any)
+	propExprs := make(map[string]any)
+	for _, spread := range spreads {
+		value, err := evalJS("("+spread+")", props)
+		if err != nil {
+			return nil, nil, err
+		}
+		obj, ok := value.(map[string]any)
+		if !ok && value != nil {
+			return nil, nil, fmt.Errorf("{...%s} can only spread an object, got %T", spread, value)
+		}
+		for prop_name, prop_value := range obj {
+			newProps[prop_name] = prop_value
+			if spread == "$props" {
+				// The props passed to this component are in scope by name on the client
+				propExprs[prop_name] = prop_name
+			} else if regexp.MustCompile(`^[A-Za-z_$][\w$]*$`).MatchString(prop_name) {
+				propExprs[prop_name] = "(" + spread + ")." + prop_name
+			} else {
+				propExprs[prop_name] = "(" + spread + ")[" + strconv.Quote(prop_name) + "]"
+			}
+		}
+	}
+	for prop_name, prop_value := range compProps {
+		// Wrapped so object literals like data={{a: 1}} aren't run as a block
+		value, err := evalJS(fmt.Sprintf(`(%s)`, prop_value), props)
+		if err != nil {
+			return nil, nil, err
+		}
+		newProps[prop_name] = value
+		propExprs[prop_name] = prop_value
+	}
+	return newProps, propExprs, nil
+}
+
+// bindSpreads turns {...attrs} spreads on HTML elements into x-bind="attrs". The HTML parser
+// lowercases attribute names, so the expression has to move into a value to keep its case
+func bindSpreads(text string) string {
+	var out strings.Builder
+	inTag := false
+	var quote byte
+	for i := 0; i < len(text); i++ {
+		c := text[i]
+		if inTag {
+			if quote != 0 {
+				if c == quote {
+					quote = 0
+				}
+			} else if c == '"' || c == '\'' {
+				quote = c
+			} else if c == '>' {
+				inTag = false
+			} else if c == '{' {
+				if end := findTagEnd(text, i); end != -1 {
+					if strings.HasPrefix(text[i:], "{...") && isSpace(text[i-1]) {
+						out.WriteString(`x-bind="` + makeExprAttr(strings.TrimSpace(text[i+len("{..."):end])) + `"`)
+					} else {
+						out.WriteString(text[i : end+1])
+					}
+					i = end
+					continue
+				}
+			}
+		} else if c == '<' && i+1 < len(text) && text[i+1] >= 'a' && text[i+1] <= 'z' {
+			inTag = true
+		}
+		out.WriteByte(c)
+	}
+	return out.String()
+}
+
+// extendLayout renders the layout a template extends with the template's {block}s filled in.
+// The layout is rendered with the template's props, and its markup is scoped on its own
+// so its styles don't reach the blocks, which belong to the template extending it
+func extendLayout(tmpl *compiledTemplate, props map[string]any, frame *renderFrame) (string, error) {
+	blocks := map[string]string{}
+	for _, ctrl := range tmpl.controlTree {
+		if ctrl.isTextNode && strings.TrimSpace(ctrl.textContent) == "" {
+			continue
+		}
+		if !ctrl.isBlock {
+			index := ctrl.index
+			if ctrl.isTextNode {
+				index += len(ctrl.textContent) - len(strings.TrimLeft(ctrl.textContent, " \t\r\n"))
+			}
+			return "", markupErrorf(index, "only {block} can be at the top level of a template that extends a layout")
+		}
+		if _, ok := blocks[ctrl.blockName]; ok {
+			return "", markupErrorf(ctrl.index, "{block %s} is defined more than once", ctrl.blockName)
+		}
+		content, err := evalControlTree(ctrl.children, props, frame)
+		if err != nil {
+			return "", errorAt(ctrl.index, err)
+		}
+		blocks[ctrl.blockName] = content
+	}
+
+	layoutPath := tmpl.extends
+	for i, path := range frame.chain {
+		if path == layoutPath {
+			return "", fmt.Errorf("circular extends: %s", strings.Join(append(frame.chain[i:], layoutPath), " > "))
+		}
+	}
+	// The page's context goes with it so the layout's <html> has it for the client
+	layoutProps := make(map[string]any, len(props))
+	for k, v := range props {
+		if k != "$props" {
+			layoutProps[k] = v
+		}
+	}
+	markup, script, style, _, err := RecursiveRender(layoutPath, layoutProps, frame)
+	if err != nil {
+		return "", err
+	}
+	markup, scopedElements, err := scopeHTML(markup, layoutProps)
+	if err != nil {
+		layout, _ := compileTemplate(layoutPath, frame.state.config.TrimWhitespace)
+		return "", diagnose(layout.layout, layoutPath, frame.chain, err)
+	}
+	frame.state.scopeStack = append(frame.state.scopeStack, scopeStackItem{
+		scopedElements: scopedElements,
+		style:          style,
+		script:         script,
+	})
+	return fillBlocks(markup, blocks), nil
+}
+
+// fillBlocks puts the content of each block into the layout's block placeholder with the same name.
+// The placeholders stay around the content so a template further down can still replace it
+func fillBlocks(markup string, blocks map[string]string) string {
+	var out strings.Builder
+	for {
+		start := strings.Index(markup, blockPlaceholderStart)
+		if start == -1 {
+			break
+		}
+		headerEnd := start + strings.Index(markup[start:], "-->") + len("-->")
+		name := markup[start+len(blockPlaceholderStart) : headerEnd-len("-->")]
+		end := findPlaceholderEnd(markup, headerEnd, blockPlaceholderStart, blockPlaceholderEnd)
+		if end == -1 {
+			break
+		}
+		out.WriteString(markup[:headerEnd])
+		if content, ok := blocks[name]; ok {
+			out.WriteString(content)
+		} else {
+			// Blocks nested in the default content can still be filled
+			out.WriteString(fillBlocks(markup[headerEnd:end], blocks))
+		}
+		out.WriteString(blockPlaceholderEnd)
+		markup = markup[end+len(blockPlaceholderEnd):]
+	}
+	out.WriteString(markup)
+	return out.String()
+}
+
+// resolveDynamicPath resolves a dynamic component's path against config.DynamicRoot
+// and makes sure it stays inside of it and matches config.DynamicAllow
+func resolveDynamicPath(compPath string, config Config) (string, error) {
+	root := config.DynamicRoot
+	if root == "" {
+		root = "."
+	}
+	resolved := filepath.Join(root, compPath)
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("dynamic component %q is outside of %s", compPath, root)
+	}
+	// A symlink inside the root could still point outside of it
+	if realPath, err := filepath.EvalSymlinks(resolved); err == nil {
+		realRoot, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			return "", fmt.Errorf("dynamic component root %s: %w", root, err)
+		}
+		realRel, err := filepath.Rel(realRoot, realPath)
+		if err != nil || realRel == ".." || strings.HasPrefix(realRel, ".."+string(filepath.Separator)) {
+			return "", fmt.Errorf("dynamic component %q links outside of %s", compPath, root)
+		}
+	}
+	if len(config.DynamicAllow) == 0 {
+		return resolved, nil
+	}
+	for _, pattern := range config.DynamicAllow {
+		if matched, _ := filepath.Match(pattern, rel); matched {
+			return resolved, nil
+		}
+	}
+	return "", fmt.Errorf("dynamic component %q isn't allowed by config.DynamicAllow", compPath)
+}
+
+// renderComp renders a component and scopes its markup, styles and script
+func renderComp(ctrl control, compPath string, newProps map[string]any, compProps map[string]any, frame *renderFrame) (string, error) {
+	events, client, state := ctrl.compEvents, ctrl.compClient, frame.state
+	if err := checkRecursion(compPath, frame); err != nil {
+		return "", err
+	}
+	if client == "none" && len(events) > 0 {
+		return "", fmt.Errorf("on:%s can't be used with client:none, events need the component to hydrate", sortedKeys(events)[0])
+	}
+	if err := checkEvents(compPath, events, state.config); err != nil {
+		return "", err
+	}
+	if client == "only" {
+		return renderClientOnly(compPath, newProps, compProps, events, frame)
+	}
+	markup, script, style, fence_logic, err := RecursiveRender(compPath, newProps, frame)
+	if err != nil {
+		return "", err
+	}
+	tmpl, _ := compileTemplate(compPath, state.config.TrimWhitespace)
+	// Create scoped classes and add to html
+	markup, scopedElements, err := scopeHTMLComp(markup, newProps, compProps, fence_logic, events, len(tmpl.events) > 0)
+	if err != nil {
+		// The expressions that failed are in the component, so point at its file
+		return "", diagnose(tmpl.layout, compPath, frame.chain, err)
+	}
+	markup, err = makeIsland(markup, client)
+	if err != nil {
+		return "", err
+	}
+	// Add scoped classes to css
+	state.scopeStack = append(state.scopeStack, scopeStackItem{
+		scopedElements: scopedElements,
+		style:          style,
+		script:         script,
+	})
+	return markup, nil
+}
+
+// renderClientOnly ships a client:only component as a <template> that Alpine mounts in the browser instead of
+// rendering it. The fence runs on the client with the props the template using it passes, and gets run again
+// when they change, so only the props' types are checked here
+func renderClientOnly(compPath string, newProps map[string]any, compProps map[string]any, events map[string]string, frame *renderFrame) (string, error) {
+	tmpl, err := compileTemplate(compPath, frame.state.config.TrimWhitespace)
+	if err != nil {
+		return "", diagnose(tmpl.layout, compPath, frame.chain, err)
+	}
+	err = checkRequiredProps(compPath, tmpl.required, newProps)
+	if err == nil {
+		err = checkPropTypes(compPath, tmpl.propTypes, newProps)
+	}
+	if err != nil {
+		return "", err
+	}
+	if tmpl.extends != "" {
+		return "", fmt.Errorf("%s can't be client:only, it extends a layout and those only render on the server", compPath)
+	}
+	markup, err := clientMarkup(tmpl.controlTree, "a client:only component")
+	if err == nil {
+		markup, err = bindClientText(markup)
+	}
+	if err != nil {
+		return "", diagnose(tmpl.layout, compPath, frame.chain, err)
+	}
+	markup, scopedElements, err := scopeHTMLComp(markup, map[string]any{}, nil, "", nil, false)
+	if err != nil {
+		return "", diagnose(tmpl.layout, compPath, frame.chain, err)
+	}
+
+	// Passed props are the fence's parameters, the rest of the props keep their defaults
+	fence_logic := tmpl.fence
+	for name := range compProps {
+		fence_logic = regexp.MustCompile(`\bprop\s+`+regexp.QuoteMeta(name)+`\b(\s*=.*?)?;`).ReplaceAllString(fence_logic, "")
+	}
+	fence_logic = makeAttrStr(regexp.MustCompile(`\bprop\s+`).ReplaceAllString(fence_logic, "let "))
+	params_str, args_str := getterArgs(compProps, fence_logic)
+	x_data_str := fmt.Sprintf("{_fence: `%s`, ", fence_logic)
+	for _, name := range tmpl.allVars {
+		x_data_str += name + ": undefined, "
+	}
+	attrs := []html.Attribute{{Key: "style", Val: "display: contents"}, {Key: "x-data", Val: x_data_str + "}"}}
+	if len(tmpl.allVars) > 0 {
+		// Everything the fence declares is set at once, and again when the template using it changes
+		run := fmt.Sprintf("Object.assign($data, new Function('%s', `${_fence}; return {%s};`)(%s))", params_str, strings.Join(tmpl.allVars, ", "), args_str)
+		attrs = append(attrs, html.Attribute{Key: "x-init", Val: run + ", $watch('Alpine.$data($el.parentElement)', () => " + run + ")"})
+	}
+	if len(tmpl.events) > 0 {
+		attrs = append(attrs, html.Attribute{Key: "data-plenti-events"})
+	}
+	// The handlers go on the wrapper so they run in the x-data of the template using the component
+	for _, event := range sortedKeys(events) {
+		attrs = append(attrs, html.Attribute{Key: "x-on:" + event, Val: makeEventHandler(events[event])})
+	}
+	wrapper := html.Token{Type: html.StartTagToken, Data: "div", Attr: attrs}
+	// The <template> goes in a display: contents element too, at the top of a page the parser would move it into <head>
+	markup = `<div style="display: contents"><template x-if="true">` + wrapper.String() + markup + `</div></template></div>`
+
+	frame.state.scopeStack = append(frame.state.scopeStack, scopeStackItem{
+		scopedElements: scopedElements,
+		style:          tmpl.style,
+		script:         tmpl.script,
+	})
+	return markup, nil
+}
+
+// clientMarkup turns a control tree back into markup that Alpine renders in the browser,
+// with {if}, {for} and {switch} as <template>s. The brackets are left for bindClientText.
+// where names what's being rendered in the browser for the errors about what it can't have
+func clientMarkup(tree []control, where string) (string, error) {
+	var out strings.Builder
+	for _, ctrl := range tree {
+		if ctrl.isTextNode {
+			out.WriteString(ctrl.textContent)
+		} else if ctrl.isRawHTML {
+			out.WriteString(html.Token{Type: html.StartTagToken, Data: "div", Attr: []html.Attribute{
+				{Key: "style", Val: "display: contents"},
+				{Key: "x-html", Val: makeExprAttr(ctrl.rawHTMLExpr)},
+			}}.String() + "</div>")
+		} else if ctrl.isIfStmt {
+			conditions := []string{"(" + ctrl.ifCondition + ")"}
+			markup, err := clientBranch([]html.Attribute{{Key: "x-if", Val: conditions[0]}}, ctrl.children, where)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(markup)
+			for _, child := range ctrl.children {
+				condition := "!(" + strings.Join(conditions, " || ") + ")"
+				if child.isElseIfStmt {
+					conditions = append(conditions, "("+child.elseIfCondition+")")
+					condition += " && " + conditions[len(conditions)-1]
+				} else if !child.isElseStmt {
+					continue
+				}
+				markup, err := clientBranch([]html.Attribute{{Key: "x-if", Val: condition}}, child.children, where)
+				if err != nil {
+					return "", err
+				}
+				out.WriteString(markup)
+			}
+		} else if ctrl.isForLoop {
+			attrs, collection := clientForAttrs(ctrl)
+			markup, err := clientBranch(attrs, ctrl.children, where)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(markup)
+			if elseBranch := getElseBranch(ctrl); elseBranch != nil {
+				markup, err := clientBranch([]html.Attribute{{Key: "x-if", Val: collection + ".length === 0"}}, elseBranch.children, where)
+				if err != nil {
+					return "", err
+				}
+				out.WriteString(markup)
+			}
+		} else if ctrl.isSwitchStmt {
+			conditions := []string{}
+			var defaultBranch *control
+			for i, child := range ctrl.children {
+				if child.isDefaultStmt {
+					defaultBranch = &ctrl.children[i]
+				}
+				if !child.isCaseStmt {
+					continue
+				}
+				condition := "[" + strings.Join(child.caseValues, ", ") + "].some(value => value === (" + ctrl.switchExpr + "))"
+				if len(conditions) > 0 {
+					condition = "!(" + strings.Join(conditions, " || ") + ") && " + condition
+				}
+				conditions = append(conditions, "["+strings.Join(child.caseValues, ", ")+"].some(value => value === ("+ctrl.switchExpr+"))")
+				markup, err := clientBranch([]html.Attribute{{Key: "x-if", Val: condition}}, child.children, where)
+				if err != nil {
+					return "", err
+				}
+				out.WriteString(markup)
+			}
+			if defaultBranch != nil {
+				condition := "true"
+				if len(conditions) > 0 {
+					condition = "!(" + strings.Join(conditions, " || ") + ")"
+				}
+				markup, err := clientBranch([]html.Attribute{{Key: "x-if", Val: condition}}, defaultBranch.children, where)
+				if err != nil {
+					return "", err
+				}
+				out.WriteString(markup)
+			}
+		} else if ctrl.isElseIfStmt || ctrl.isElseStmt || ctrl.isCaseStmt || ctrl.isDefaultStmt {
+			continue // Rendered with the {if}, {for} or {switch} they belong to
+		} else if ctrl.isBinding {
+			return "", markupErrorf(ctrl.index, "{%s} can't be used in %s yet, declare it in the fence instead", ctrl.bindingKeyword, where)
+		} else if ctrl.isComp || ctrl.isDynamicComp {
+			return "", markupErrorf(ctrl.index, "components can't be used in %s yet", where)
+		} else if ctrl.isSlot {
+			return "", markupErrorf(ctrl.index, "<slot> can't be used in %s yet", where)
+		} else if ctrl.isBlock {
+			return "", markupErrorf(ctrl.index, "{block} can't be used in %s", where)
+		} else if ctrl.isAwaitBlock {
+			return "", markupErrorf(ctrl.index, "{await} can't be used in %s yet", where)
+		}
+	}
+	return out.String(), nil
+}
+
+// clientBranch wraps the client markup of a control's children in a <template> with the given directives.
+// Alpine needs the template to have a single root, so anything else goes in a display: contents element
+func clientBranch(attrs []html.Attribute, children []control, where string) (string, error) {
+	markup, err := clientMarkup(children, where)
+	if err != nil {
+		return "", err
+	}
+	for i := range attrs {
+		attrs[i].Val = makeExprAttr(attrs[i].Val)
+	}
+	if !hasSingleRoot(markup) {
+		markup = `<div style="display: contents">` + markup + "</div>"
+	}
+	return html.Token{Type: html.StartTagToken, Data: "template", Attr: attrs}.String() + markup + "</template>", nil
+}
+
+// clientForAttrs returns the x-for and :key directives that loop like a {for} does in the browser,
+// along with the array it loops over
+func clientForAttrs(ctrl control) ([]html.Attribute, string) {
+	item := ctrl.forVar
+	if ctrl.forIndex != "" {
+		item = "(" + ctrl.forVar + ", " + ctrl.forIndex + ")"
+	}
+	collection := "Array.from(" + ctrl.forCollection + " ?? [])"
+	if ctrl.forIn {
+		collection = "Object.keys(" + ctrl.forCollection + " ?? {})"
+	}
+	attrs := []html.Attribute{{Key: "x-for", Val: item + " in " + collection}}
+	if ctrl.forKey != "" {
+		attrs = append(attrs, html.Attribute{Key: ":key", Val: ctrl.forKey})
+	}
+	return attrs, collection
+}
+
+// hasSingleRoot checks if markup is one element with nothing but whitespace around it,
+// which Alpine can clone from a <template> on its own
+func hasSingleRoot(markup string) bool {
+	roots := 0
+	depth := 0
+	z := html.NewTokenizer(strings.NewReader(markup))
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return roots == 1
+		case html.TextToken:
+			if depth == 0 && strings.TrimSpace(string(z.Text())) != "" {
+				return false
+			}
+		case html.CommentToken:
+			if depth == 0 {
+				return false
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			if depth == 0 && string(name) == "template" {
+				return false // Alpine doesn't render a nested <template> as the root
+			}
+			if depth == 0 {
+				roots++
+			}
+			if tt == html.StartTagToken && !voidElements[string(name)] {
+				depth++
+			}
+		case html.EndTagToken:
+			depth--
+		}
+	}
+}
+
+// bindClientText moves the brackets in client markup into the x-text and :attr bindings that Alpine renders them with.
+// Text that's alone in its element binds to the element, other text gets a <span> of its own so x-text doesn't wipe out its siblings
+func bindClientText(markup string) (string, error) {
+	tokens := []fragmentToken{}
+	z := html.NewTokenizer(strings.NewReader(markup))
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			if z.Err() == io.EOF {
+				break
+			}
+			return "", fmt.Errorf("failed to parse HTML: %w", z.Err())
+		}
+		raw := string(z.Raw())
+		token := z.Token()
+		if tt == html.StartTagToken || tt == html.SelfClosingTagToken {
+			attrs := make([]html.Attribute, 0, len(token.Attr))
+			for _, attr := range token.Attr {
+				// Alpine directives already hold JS instead of template text
+				if !strings.Contains(attr.Val, "{") || !strings.Contains(attr.Val, "}") || strings.HasPrefix(attr.Key, "x-") || strings.HasPrefix(attr.Key, ":") || strings.HasPrefix(attr.Key, "@") {
+					attrs = append(attrs, attr)
+					continue
+				}
+				attrs = append(attrs, html.Attribute{
+					Key: ":" + attr.Key,
+					Val: strings.ReplaceAll(clientTemplate(attr.Val, attrContext(attr.Key)), "\"", "'"),
+				})
+			}
+			token.Attr = attrs
+			raw = ""
+		}
+		tokens = append(tokens, fragmentToken{token: token, raw: raw})
+	}
+
+	var out strings.Builder
+	for i, t := range tokens {
+		text := t.token.Data
+		inRawText := i > 0 && tokens[i-1].token.Type == html.StartTagToken && (tokens[i-1].token.Data == "script" || tokens[i-1].token.Data == "style")
+		if t.token.Type == html.TextToken && !inRawText && strings.Contains(text, "{") && strings.Contains(text, "}") {
+			xText := html.Attribute{Key: "x-text", Val: clientText(text)}
+			if i > 0 && i+1 < len(tokens) && tokens[i-1].token.Type == html.StartTagToken && tokens[i+1].token.Type == html.EndTagToken && tokens[i+1].token.Data == tokens[i-1].token.Data {
+				tokens[i-1].token.Attr = append(tokens[i-1].token.Attr, xText)
+				tokens[i] = fragmentToken{token: html.Token{Type: html.TextToken}}
+			} else {
+				tokens[i] = fragmentToken{raw: html.Token{Type: html.StartTagToken, Data: "span", Attr: []html.Attribute{xText}}.String() + "</span>"}
+			}
+		}
+	}
+	for _, t := range tokens {
+		if t.raw != "" {
+			out.WriteString(t.raw)
+		} else {
+			out.WriteString(t.token.String())
+		}
+	}
+	return out.String(), nil
+}
+
+// makeIsland changes how a rendered component hydrates for its client: directive. With client:none it's
+// plain HTML, and client:visible waits to start Alpine on it until it's scrolled into view
+func makeIsland(markup string, client string) (string, error) {
+	switch client {
+	case "none":
+		return stripHydration(markup)
+	case "visible":
+		// The component's elements might not have a box to observe, like a display: contents wrapper or
+		// text on its own, so 1px sentinels with a negative margin mark its start and end instead
+		init := "const _island = $el.children[1]; const _observer = new IntersectionObserver(entries => { if (entries.some(entry => entry.isIntersecting)) { _observer.disconnect(); _island.removeAttribute('x-ignore'); delete _island._x_ignore; Alpine.initTree(_island) } }); _observer.observe($el.children[0]); _observer.observe($el.children[2])"
+		return `<div style="display: contents" x-init="` + init + `"><div aria-hidden="true" style="height: 1px; margin-bottom: -1px"></div><div style="display: contents" x-ignore>` + markup + `</div><div aria-hidden="true" style="height: 1px; margin-top: -1px"></div></div>`, nil
+	}
+	return markup, nil
+}
+
+// stripHydration removes the Alpine directives from markup, along with the <template>s only Alpine would render
+func stripHydration(markup string) (string, error) {
+	nodes, err := html.ParseFragment(strings.NewReader(markup), &html.Node{
+		Type:     html.ElementNode,
+		Data:     "body",
+		DataAtom: atom.Body,
+	})
+	if err != nil {
+		return "", err
+	}
+	isDirective := func(attr html.Attribute) bool {
+		return strings.HasPrefix(attr.Key, "x-") || strings.HasPrefix(attr.Key, "@") || strings.HasPrefix(attr.Key, ":")
+	}
+	var strip func(*html.Node)
+	strip = func(node *html.Node) {
+		for child := node.FirstChild; child != nil; {
+			next := child.NextSibling
+			if child.Type == html.ElementNode && child.Data == "template" && slices.ContainsFunc(child.Attr, isDirective) {
+				node.RemoveChild(child)
+			} else {
+				strip(child)
+			}
+			child = next
+		}
+		node.Attr = slices.DeleteFunc(node.Attr, func(attr html.Attribute) bool {
+			return isDirective(attr) || attr.Key == "data-plenti-events"
+		})
+	}
+	var out strings.Builder
+	for _, node := range nodes {
+		if node.Type == html.ElementNode && node.Data == "template" && slices.ContainsFunc(node.Attr, isDirective) {
+			continue
+		}
+		strip(node)
+		if err := html.Render(&out, node); err != nil {
+			return "", err
+		}
+	}
+	return out.String(), nil
+}
+
+// checkEvents makes sure the component at compPath declares the events it's given handlers for
+func checkEvents(compPath string, events map[string]string, config Config) error {
+	if len(events) == 0 {
+		return nil
+	}
+	tmpl, err := compileTemplate(compPath, config.TrimWhitespace)
+	if err != nil {
+		return nil // Left for the render to report
+	}
+	for _, event := range sortedKeys(events) {
+		if !slices.Contains(tmpl.events, event) {
+			return fmt.Errorf("on:%s is an event %s doesn't emit, it would need event %s; in its fence", event, compPath, event)
+		}
+	}
+	return nil
 }
 
-type scopeStackItem struct {
-	scopedElements []scopedElement
-	style          string
-	script         string
+// makeEventHandler runs an on:event handler in the x-data scope of the template using the component
+// instead of the component's own, a handler that's a function is called with the event like x-on does.
+// Alpine evaluates it against the parent element's scope, so nothing relies on with, which strict mode
+// and the CSP build don't allow. It only runs for events the component dispatched itself, not native
+// ones like an <input>'s change or ones from another component inside it, which also bubble up to the root
+func makeEventHandler(handler string) string {
+	return "$event instanceof CustomEvent && $event.target.closest('[data-plenti-events]') === $el && Alpine.evaluate($el.parentElement, '" + handlerEscaper.Replace(makeExprAttr(handler)) + "', {scope: {$event}, params: [$event]})"
 }
 
-// addXDataAttribute adds x-data="" to all top-level HTML elements
-// func addXDataAttribute(htmlStr string, newProps map[string]any) (string, error) {
-func addXDataAttribute(htmlStr string, dataStr string) (string, error) {
-	// Parse the HTML string
-	doc, err := html.Parse(strings.NewReader(htmlStr))
+// handlerEscaper makes a handler the content of a single quoted JS string
+var handlerEscaper = strings.NewReplacer(`\`, `\\`, `'`, `\'`, "\n", `\n`, "\r", `\r`, "\u2028", `\u2028`, "\u2029", `\u2029`)
+
+// sortedKeys returns the keys of a map in order, so output doesn't change between renders
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// checkRecursion stops a component that's already rendering from rendering inside itself forever.
+// The first time it comes around it's only an error when nothing in the cycle could stop it,
+// otherwise it's allowed until it's nested config.MaxRecursion times
+func checkRecursion(compPath string, frame *renderFrame) error {
+	chain, state := frame.chain, frame.state
+	depth := 0
+	last := -1
+	for i, path := range chain {
+		if path == compPath {
+			depth++
+			last = i
+		}
+	}
+	if depth == 0 {
+		return nil
+	}
+	cycle := append(append([]string{}, chain[last:]...), compPath)
+	maxRecursion := state.config.MaxRecursion
+	if maxRecursion <= 0 {
+		maxRecursion = 100
+	}
+	if depth >= maxRecursion {
+		return fmt.Errorf("component recursion is more than %d levels deep: %s", maxRecursion, strings.Join(cycle, " > "))
+	}
+	if depth > 1 {
+		return nil
+	}
+	for i := 0; i < len(cycle)-1; i++ {
+		unguarded, err := rendersUnguarded(cycle[i], cycle[i+1], state)
+		if err != nil || !unguarded {
+			return nil // Errors are left for the render to report where they happen
+		}
+	}
+	return fmt.Errorf("circular import: %s", strings.Join(cycle, " > "))
+}
+
+// rendersUnguarded checks if the template at path always renders the component at compPath,
+// because it isn't inside an {if}, {for} or anything else that could leave it out
+func rendersUnguarded(path, compPath string, state *renderState) (bool, error) {
+	tmpl, err := compileTemplate(path, state.config.TrimWhitespace)
+	if err != nil {
+		return false, err
+	}
+	components, err := templateComponents(tmpl.imports, state)
 	if err != nil {
-		return "", fmt.Errorf("failed to parse HTML: %w", err)
+		return false, err
 	}
+	return usesUnguarded(tmpl.controlTree, path, compPath, components, state), nil
+}
 
-	// Find the body node (html.Parse wraps fragments in <html><body>)
-	var body *html.Node
-	var findBody func(*html.Node)
-	findBody = func(n *html.Node) {
-		if n.Type == html.ElementNode && n.Data == "body" {
-			body = n
-			return
+// usesUnguarded looks for compPath in the controls of the template at path that always render,
+// which goes into elements, {block}s and the content passed to a component's <slot>
+func usesUnguarded(tree []control, path, compPath string, components []Component, state *renderState) bool {
+	for _, ctrl := range tree {
+		if ctrl.isIfStmt || ctrl.isForLoop || ctrl.isSwitchStmt || ctrl.isAwaitBlock || ctrl.isSlot {
+			continue // Only rendered for some values, a <slot>'s fallback only when nothing is passed to it
+		}
+		if !ctrl.isComp && !ctrl.isDynamicComp {
+			if usesUnguarded(ctrl.children, path, compPath, components, state) {
+				return true
+			}
+			continue
 		}
-		for c := n.FirstChild; c != nil; c = c.NextSibling {
-			findBody(c)
+		usedPath := usedComponentPath(ctrl, path, components, state)
+		if usedPath == compPath {
+			return true
+		}
+		for name, content := range ctrl.slots {
+			if usedPath != "" && rendersSlot(usedPath, name, state) && usesUnguarded(content.tree, path, compPath, components, state) {
+				return true
+			}
 		}
 	}
-	findBody(doc)
+	return false
+}
 
-	if body == nil {
-		return "", fmt.Errorf("no body node found")
+// usedComponentPath returns the file a component tag in the template at path renders,
+// or "" when it isn't known until the template is rendered
+func usedComponentPath(ctrl control, path string, components []Component, state *renderState) string {
+	if ctrl.isComp && ctrl.compName == "Self" {
+		return path
 	}
+	if ctrl.isComp {
+		usedPath := ""
+		for _, comp := range components {
+			if comp.Name == ctrl.compName {
+				usedPath = comp.Path
+			}
+		}
+		return usedPath
+	}
+	if ctrl.isDynamicComp && !strings.Contains(ctrl.dynamicCompPath, "{") {
+		usedPath, _ := resolveDynamicPath(ctrl.dynamicCompPath, state.config)
+		return usedPath
+	}
+	return ""
+}
 
-	// Add x-data="" to all top-level elements in the body
-	for c := body.FirstChild; c != nil; c = c.NextSibling {
-		if c.Type == html.ElementNode {
-			// Check if x-data attribute already exists
-			hasXData := false
-			for _, attr := range c.Attr {
-				if attr.Key == "x-data" {
-					hasXData = true
-					break
-				}
+// rendersSlot checks if the component at path always renders its <slot> with the given name,
+// so the content passed to it does too
+func rendersSlot(path, name string, state *renderState) bool {
+	tmpl, err := compileTemplate(path, state.config.TrimWhitespace)
+	if err != nil {
+		return false
+	}
+	var find func(tree []control) bool
+	find = func(tree []control) bool {
+		for _, ctrl := range tree {
+			if ctrl.isSlot && ctrl.slotName == name {
+				return true
 			}
-			// Add x-data="" if not present
-			if !hasXData {
-				c.Attr = append(c.Attr, html.Attribute{Key: "x-data", Val: dataStr})
+			// Passed on to another component's <slot>, it's up to that component if it renders
+			forwarded := ctrl.isComp || ctrl.isDynamicComp
+			if !ctrl.isIfStmt && !ctrl.isForLoop && !ctrl.isSwitchStmt && !ctrl.isAwaitBlock && !ctrl.isSlot && !forwarded && find(ctrl.children) {
+				return true
 			}
 		}
+		return false
 	}
+	return find(tmpl.controlTree)
+}
 
-	// Render the modified HTML
-	var buf bytes.Buffer
-	for c := body.FirstChild; c != nil; c = c.NextSibling {
-		if err := html.Render(&buf, c); err != nil {
-			return "", fmt.Errorf("failed to render HTML: %w", err)
+// makeSlotPlaceholder starts a slot's placeholder. The name and props are kept on the render's state
+// as Go values and the placeholder only holds their ID, so nothing in them can end the comment early
+func makeSlotPlaceholder(name string, slotProps map[string]any, state *renderState) string {
+	state.slots = append(state.slots, slotFill{name: name, props: slotProps})
+	return slotPlaceholderStart + strconv.Itoa(len(state.slots)-1) + "-->"
+}
+
+// slotContent is what the parent passes to one of a component's slots
+type slotContent struct {
+	tree []control
+	lets map[string]string // Slot prop name to the name it's bound to
+}
+
+// fillSlots replaces the slot placeholders in a rendered component with the content
+// passed between the component's tags, rendered with the props of the template using it.
+// Slots the content doesn't fill keep their fallback
+func fillSlots(markup string, ctrl control, props map[string]any, frame *renderFrame) (string, error) {
+	var out strings.Builder
+	for {
+		start := strings.Index(markup, slotPlaceholderStart)
+		if start == -1 {
+			break
+		}
+		headerEnd := start + strings.Index(markup[start:], "-->") + len("-->")
+		header := markup[start+len(slotPlaceholderStart) : headerEnd-len("-->")]
+		end := findPlaceholderEnd(markup, headerEnd, slotPlaceholderStart, slotPlaceholderEnd)
+		if end == -1 {
+			return "", fmt.Errorf("slot placeholder is never closed")
+		}
+		fallback := markup[headerEnd:end]
+		out.WriteString(markup[:start])
+		markup = markup[end+len(slotPlaceholderEnd):]
+
+		id, err := strconv.Atoi(header)
+		if err != nil || id < 0 || id >= len(frame.state.slots) {
+			return "", fmt.Errorf("slot placeholder %q doesn't match a <slot>", header)
+		}
+		slot := frame.state.slots[id]
+		content, ok := ctrl.slots[slot.name]
+		if !ok {
+			fallback, err := fillSlots(fallback, control{}, props, frame)
+			if err != nil {
+				return "", err
+			}
+			out.WriteString(fallback)
+			continue
+		}
+
+		newProps := props
+		bindings := map[string]any{}
+		if len(content.lets) > 0 {
+			newProps = make(map[string]any)
+			for k, v := range props {
+				newProps[k] = v
+			}
+			for prop_name, binding := range content.lets {
+				bindings[binding] = slot.props[prop_name]
+				newProps[binding] = slot.props[prop_name]
+			}
+		}
+		rendered, err := evalControlTree(content.tree, newProps, frame)
+		if err != nil {
+			return "", err
+		}
+		if len(bindings) > 0 {
+			// Evaluate the slot props now, while they're in scope, and hand them to Alpine
+			rendered, err = addXDataAttribute(rendered, makeAttrStr(anyToString(bindings)), nil, newProps)
+			if err != nil {
+				return "", err
+			}
 		}
+		out.WriteString(rendered)
 	}
+	out.WriteString(markup)
+	return out.String(), nil
+}
 
-	return buf.String(), nil
+// findPlaceholderEnd returns the index of the placeholder end that matches a placeholder
+// whose fallback starts at markup[start], skipping over placeholders nested in the fallback
+func findPlaceholderEnd(markup string, start int, placeholderStart string, placeholderEnd string) int {
+	depth := 1
+	for i := start; i < len(markup); i++ {
+		if strings.HasPrefix(markup[i:], placeholderStart) {
+			depth++
+		} else if strings.HasPrefix(markup[i:], placeholderEnd) {
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
 }
 
-func evalControlTree(controlTree []control, scopeStack []scopeStackItem, props map[string]any, components []Component) (string, []scopeStackItem) {
-	var markupBuilder strings.Builder
+// buildSlots splits the content of every component in the tree by slot, so it's only done
+// once per template instead of every time the component is rendered
+func buildSlots(tree []control) error {
+	for i := range tree {
+		if !tree[i].isComp {
+			if err := buildSlots(tree[i].children); err != nil {
+				return err
+			}
+			continue
+		}
+		slots, err := splitSlots(tree[i])
+		if err != nil {
+			return err
+		}
+		for _, content := range slots {
+			if err := buildSlots(content.tree); err != nil {
+				return err
+			}
+		}
+		tree[i].slots = slots
+	}
+	return nil
+}
 
-	for _, ctrl := range controlTree {
-		if ctrl.isTextNode {
-			markupBuilder.WriteString(ctrl.textContent)
-		} else if ctrl.isIfStmt {
-			if isBoolAndTrue(evalJS(ctrl.ifCondition, props)) {
-				markup, newScopeStack := evalControlTree(ctrl.children, scopeStack, props, components)
-				markupBuilder.WriteString(markup)
-				scopeStack = newScopeStack
-			} else {
-				evaluated := false
-				// Process else-if statements
-				for _, child := range ctrl.children {
-					if child.isElseIfStmt && isBoolAndTrue(evalJS(child.elseIfCondition, props)) {
-						markup, newScopeStack := evalControlTree(child.children, scopeStack, props, components)
-						markupBuilder.WriteString(markup)
-						scopeStack = newScopeStack
-						evaluated = true
-						break
-					}
-				}
-				// Process else statement if no else-if was true
-				if !evaluated {
-					for _, child := range ctrl.children {
-						if child.isElseStmt {
-							markup, newScopeStack := evalControlTree(child.children, scopeStack, props, components)
-							markupBuilder.WriteString(markup)
-							scopeStack = newScopeStack
-							break
+// splitSlots sorts the content between a component's tags by the slot it goes in. Top-level
+// elements with a slot="name" attribute go in that named slot and everything else in the default one.
+// Each slot's control tree is built from a copy of the markup with everything else blanked out,
+// so indexes still point at the template for diagnostics
+func splitSlots(ctrl control) (map[string]*slotContent, error) {
+	slots := map[string]*slotContent{}
+	if ctrl.slotEnd <= ctrl.slotStart {
+		return slots, nil
+	}
+	content := ctrl.slotMarkup[ctrl.slotStart:ctrl.slotEnd]
+	masks := map[string][]byte{}
+	mask := func(name string) []byte {
+		if masks[name] == nil {
+			masks[name] = []byte(strings.Repeat(string(trimmedChar), len(ctrl.slotMarkup)))
+		}
+		return masks[name]
+	}
+	lets := map[string]map[string]string{"": ctrl.slotLets}
+	reSlotAttr := regexp.MustCompile(`\s+(?:slot=(?:"[^"]*"|'[^']*')|let:[A-Za-z_$][\w$]*(?:=\{[^}]*\})?)`)
+
+	z := html.NewTokenizer(strings.NewReader(content))
+	pos := ctrl.slotStart
+	named := ""
+	depth := 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			break
+		}
+		raw := string(z.Raw())
+		token := z.Token()
+		name := named
+		if depth == 0 && (tt == html.StartTagToken || tt == html.SelfClosingTagToken) {
+			for _, attr := range token.Attr {
+				if attr.Key == "slot" {
+					name = attr.Val
+					named = attr.Val
+					letAttrs := ""
+					for _, attr := range token.Attr {
+						if strings.HasPrefix(attr.Key, "let:") {
+							letAttrs += " " + attr.Key
+							if attr.Val != "" {
+								letAttrs += "={" + strings.Trim(attr.Val, "{} ") + "}"
+							}
 						}
 					}
+					lets[name], _ = getSlotLets(letAttrs)
 				}
 			}
-		} else if ctrl.isForLoop {
-			iterableVal := evalJS(ctrl.forCollection, props)
-			items, ok := iterableVal.([]any)
-			if ok {
-				for _, item := range items {
-					newProps := make(map[string]any)
-					for k, v := range props {
-						newProps[k] = v
-					}
-					newProps[ctrl.forVar] = item
-					markup, newScopeStack := evalControlTree(ctrl.children, scopeStack, newProps, components)
-					//markup, _ = addXDataAttribute(markup, newProps)
-					dataStr := "{" + ctrl.forVar + ": " + makeAttrStr(anyToString(item)) + "}"
-					markup, _ = addXDataAttribute(markup, dataStr)
-					markupBuilder.WriteString(markup)
-					scopeStack = newScopeStack
-				}
-			}
-		} else if ctrl.isComp {
-			newProps := make(map[string]any)
-			for prop_name, prop_value := range ctrl.compProps {
-				// Evaluate the passed in props within the context of the parent comp
-				newProps[prop_name] = evalJS(fmt.Sprintf(`%s`, prop_value), props)
-			}
-			var compPath string
-			for _, comp := range components {
-				if comp.Name == ctrl.compName {
-					compPath = comp.Path
-				}
+		}
+		copy(mask(name)[pos:], raw)
+		if name != "" && depth == 0 && named != "" {
+			// Drop the slot and let: attributes from the element that names the slot
+			for _, loc := range reSlotAttr.FindAllStringIndex(raw, -1) {
+				copy(mask(name)[pos+loc[0]:], strings.Repeat(string(trimmedChar), loc[1]-loc[0]))
 			}
-			markup, script, style, newScopeStack, fence_logic := RecursiveRender(compPath, newProps, scopeStack)
-			// Create scoped classes and add to html
-			markup, scopedElements := scopeHTMLComp(markup, newProps, ctrl.compProps, fence_logic)
-			// Add scoped classes to css
-			newScopeStack = append(newScopeStack, scopeStackItem{
-				scopedElements: scopedElements,
-				style:          style,
-				script:         script,
-			})
-			scopeStack = newScopeStack
-			markupBuilder.WriteString(markup)
-		} else if ctrl.isDynamicComp {
-			newProps := make(map[string]any)
-			for prop_name, prop_value := range ctrl.dynamicCompProps {
-				// Evaluate the passed in props within the context of the parent comp
-				newProps[prop_name] = evalJS(fmt.Sprintf(`%s`, prop_value), props)
-			}
-			evaluatedCompPath := evalAllBrackets(ctrl.dynamicCompPath, props)
-			markup, script, style, newScopeStack, fence_logic := RecursiveRender(evaluatedCompPath, newProps, scopeStack)
-			// Create scoped classes and add to html
-			markup, scopedElements := scopeHTMLComp(markup, newProps, ctrl.compProps, fence_logic)
-			// Add scoped classes to css
-			newScopeStack = append(newScopeStack, scopeStackItem{
-				scopedElements: scopedElements,
-				style:          style,
-				script:         script,
-			})
-			scopeStack = newScopeStack
-			markupBuilder.WriteString(markup)
+		}
+		pos += len(raw)
+		if tt == html.StartTagToken && !voidElements[token.Data] {
+			depth++
+		} else if tt == html.EndTagToken {
+			depth--
+		}
+		if depth <= 0 {
+			depth = 0
+			named = ""
 		}
 	}
 
-	return markupBuilder.String(), scopeStack
+	for name, masked := range masks {
+		if strings.TrimSpace(strings.ReplaceAll(string(masked), string(trimmedChar), "")) == "" {
+			// Only whitespace was passed, so the slot keeps its fallback
+			continue
+		}
+		tree, err := buildControlTree(string(masked), false)
+		if err != nil {
+			return nil, err
+		}
+		slots[name] = &slotContent{tree: tree, lets: lets[name]}
+	}
+	return slots, nil
+}
+
+// getSlotLets removes the let:prop and let:prop={name} bindings from a tag's attributes
+// and returns them as a map of the slot prop to the name it's bound to
+func getSlotLets(attrs string) (map[string]string, string) {
+	lets := map[string]string{}
+	reLet := regexp.MustCompile(`\blet:([A-Za-z_$][\w$]*)(?:=\{\s*([A-Za-z_$][\w$]*)\s*\})?`)
+	for _, match := range reLet.FindAllStringSubmatch(attrs, -1) {
+		lets[match[1]] = match[1]
+		if match[2] != "" {
+			lets[match[1]] = match[2]
+		}
+	}
+	return lets, reLet.ReplaceAllString(attrs, "")
 }
 
 func getComponents(path, fence string) (string, []Component) {
-	parentCompDir := filepath.Dir(path)
 	components := []Component{}
 	reImport := regexp.MustCompile(`import\s+([A-Za-z_][A-Za-z_0-9]*)\s+from\s*"([^"]+)";`)
 	for _, line := range strings.Split(fence, "\n") {
 		match := reImport.FindStringSubmatch(line)
 		if len(match) > 1 {
-			compName := match[1]
-			compPath := match[2]
-			if filepath.IsAbs(compPath) {
-				compPath = "." + filepath.Clean("/"+compPath)
-			} else {
-				compPath = filepath.Join(parentCompDir, filepath.Clean("/"+compPath))
-			}
 			components = append(components, Component{
-				Name: compName,
-				Path: compPath,
+				Name: match[1],
+				Path: resolveImportPath(path, match[2]),
 			})
 			fence = reImport.ReplaceAllString(fence, "") // Remove current import so script can run in goja
 		}
@@ -977,26 +4527,247 @@ func getComponents(path, fence string) (string, []Component) {
 	return fence, components
 }
 
-func getCompArgs(comp_decl string) map[string]any {
-	comp_args := strings.SplitAfter(comp_decl, "}")
-	comp_props := map[string]any{}
-	for _, comp_arg := range comp_args {
-		comp_arg = strings.TrimSpace(comp_arg)
-		if strings.HasPrefix(comp_arg, "{") && strings.HasSuffix(comp_arg, "}") {
-			prop_name := strings.Trim(comp_arg, "{}")
-			comp_props[prop_name] = prop_name
+// resolveImportPath resolves a path in the fence of the template at path, absolute ones start at the project root
+func resolveImportPath(path, importPath string) string {
+	if filepath.IsAbs(importPath) {
+		return "." + filepath.Clean("/"+importPath)
+	}
+	return filepath.Join(filepath.Dir(path), filepath.Clean("/"+importPath))
+}
+
+// getExtends removes the extends "layout.html"; directive from the fence and returns the layout's path
+func getExtends(path, fence string) (string, string) {
+	reExtends := regexp.MustCompile(`(?m)^[ \t]*extends\s+(?:"([^"]+)"|'([^']+)');?[ \t]*$`)
+	match := reExtends.FindStringSubmatch(fence)
+	if match == nil {
+		return fence, ""
+	}
+	return reExtends.ReplaceAllString(fence, ""), resolveImportPath(path, match[1]+match[2])
+}
+
+// templateComponents returns the components a template can use. Its imports
+// come last so they win over discovered components with the same name.
+// The component dirs are only scanned once per render
+func templateComponents(imports []Component, state *renderState) ([]Component, error) {
+	if state.discovered == nil {
+		discovered, err := discoverComponents(state.config.ComponentDirs)
+		if err != nil {
+			return nil, err
+		}
+		state.discovered = discovered
+	}
+	return append(slices.Clip(state.discovered), imports...), nil
+}
+
+// discoverComponents registers every template in the component dirs by its PascalCase file name
+func discoverComponents(componentDirs []string) ([]Component, error) {
+	paths := map[string][]string{}
+	names := []string{}
+	for _, dir := range componentDirs {
+		err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() || filepath.Ext(path) != ".html" {
+				return nil
+			}
+			name := pascalCase(strings.TrimSuffix(d.Name(), ".html"))
+			if name == "" || !isUpper(name[0]) {
+				return nil // Can't be used as a component tag
+			}
+			if paths[name] == nil {
+				names = append(names, name)
+			}
+			paths[name] = append(paths[name], path)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("can't scan component dir %s: %w", dir, err)
+		}
+	}
+	components := make([]Component, 0, len(names))
+	for _, name := range names {
+		if len(paths[name]) > 1 {
+			components = append(components, Component{Name: name, Ambiguous: paths[name]})
+		} else {
+			components = append(components, Component{Name: name, Path: paths[name][0]})
+		}
+	}
+	return components, nil
+}
+
+// pascalCase turns a file name like age_button or age-button into AgeButton
+func pascalCase(str string) string {
+	var out strings.Builder
+	for _, word := range regexp.MustCompile(`[^A-Za-z0-9]+`).Split(str, -1) {
+		if word != "" {
+			out.WriteString(strings.ToUpper(word[:1]) + word[1:])
+		}
+	}
+	return out.String()
+}
+
+// quoteAttr turns a quoted attribute value into a JS string, or a template literal
+// when it has {expressions} in it like title="Hello {name}"
+func quoteAttr(str string) string {
+	if !strings.Contains(str, "{") {
+		quoted, _ := json.Marshal(str)
+		return string(quoted)
+	}
+	escapeLiteral := strings.NewReplacer("\\", "\\\\", "`", "\\`", "${", "\\${")
+	var literal strings.Builder
+	literal.WriteString("`")
+	for i := 0; i < len(str); {
+		exprStart := strings.IndexByte(str[i:], '{')
+		if exprStart == -1 {
+			literal.WriteString(escapeLiteral.Replace(str[i:]))
+			break
+		}
+		exprStart += i
+		exprEnd := findTagEnd(str, exprStart)
+		if exprEnd == -1 {
+			literal.WriteString(escapeLiteral.Replace(str[i:]))
+			break
 		}
-		if strings.Contains(comp_arg, "={") && strings.HasSuffix(comp_arg, "}") {
-			nameEndPos := strings.IndexRune(comp_arg, '=')
-			prop_name := comp_arg[0:nameEndPos]
+		literal.WriteString(escapeLiteral.Replace(str[i:exprStart]))
+		literal.WriteString("${" + str[exprStart+1:exprEnd] + "}")
+		i = exprEnd + 1
+	}
+	literal.WriteString("`")
+	return literal.String()
+}
 
-			valueStartPos := strings.IndexRune(comp_arg, '{')
-			valueEndPos := strings.IndexRune(comp_arg, '}')
+// compAttrs are the attributes passed on a component tag
+type compAttrs struct {
+	props   map[string]any    // The JS expression for each prop
+	spreads []string          // The {...expr} spreads, in order
+	lets    map[string]string // The let: bindings, from slot prop to the name it's bound to
+	events  map[string]string // The on: handlers, from event to the handler expression
+	client  string            // The client: directive for how it hydrates, none, only or visible
+}
 
-			comp_props[prop_name] = comp_arg[valueStartPos+1 : valueEndPos]
+// parseCompAttrs tokenizes the attributes of a component tag found in markup[start:end].
+// Values can be {expressions}, quoted strings, or left off for boolean attributes
+func parseCompAttrs(markup string, start int, end int) (compAttrs, error) {
+	attrs := compAttrs{props: map[string]any{}, spreads: []string{}, lets: map[string]string{}, events: map[string]string{}}
+	reIdent := regexp.MustCompile(`^[A-Za-z_$][\w$]*$`)
+	// Blanked out slot attributes are masked with trimmedChar, so they're skipped like spaces
+	isAttrSpace := func(c byte) bool {
+		return isSpace(c) || c == trimmedChar
+	}
+	for i := start; ; {
+		for i < end && isAttrSpace(markup[i]) {
+			i++
+		}
+		if i >= end {
+			break
+		}
+		attrStart := i
+		if markup[i] == '{' {
+			exprEnd := findTagEnd(markup[:end], i)
+			if exprEnd == -1 {
+				return attrs, markupErrorf(attrStart, "attribute %s missing closing \"}\"", strings.TrimSpace(markup[i:end]))
+			}
+			expr := strings.TrimSpace(markup[i+1 : exprEnd])
+			if strings.HasPrefix(expr, "...") {
+				attrs.spreads = append(attrs.spreads, strings.TrimSpace(expr[len("..."):]))
+			} else if reIdent.MatchString(expr) {
+				if _, ok := attrs.props[expr]; ok {
+					return attrs, markupErrorf(attrStart, "attribute %s is set more than once", expr)
+				}
+				attrs.props[expr] = expr
+			} else {
+				return attrs, markupErrorf(attrStart, "shorthand attribute {%s} has to be a variable name", expr)
+			}
+			i = exprEnd + 1
+		} else {
+			for i < end && !isAttrSpace(markup[i]) && !strings.ContainsRune("=\"'{}", rune(markup[i])) {
+				i++
+			}
+			name := markup[attrStart:i]
+			if name == "" {
+				return attrs, markupErrorf(attrStart, "unexpected %q in component attributes", markup[i])
+			}
+			value := "true"
+			isExpr := false
+			if i < end && markup[i] == '=' {
+				i++
+				if i >= end || isAttrSpace(markup[i]) {
+					return attrs, markupErrorf(attrStart, "attribute %s missing a value after \"=\"", name)
+				}
+				switch markup[i] {
+				case '{':
+					exprEnd := findTagEnd(markup[:end], i)
+					if exprEnd == -1 {
+						return attrs, markupErrorf(attrStart, "attribute %s missing closing \"}\"", name)
+					}
+					value = strings.TrimSpace(markup[i+1 : exprEnd])
+					if value == "" {
+						return attrs, markupErrorf(attrStart, "attribute %s has an empty {} value", name)
+					}
+					isExpr = true
+					i = exprEnd + 1
+				case '"', '\'':
+					quote := markup[i]
+					valueEnd := strings.IndexByte(markup[i+1:end], quote)
+					if valueEnd == -1 {
+						return attrs, markupErrorf(attrStart, "attribute %s missing closing %c", name, quote)
+					}
+					value = quoteAttr(markup[i+1 : i+1+valueEnd])
+					i += valueEnd + 2
+				default:
+					return attrs, markupErrorf(attrStart, "attribute %s value has to be quoted or wrapped in {}", name)
+				}
+			}
+			if i < end && !isAttrSpace(markup[i]) {
+				return attrs, markupErrorf(i, "attribute %s has to be followed by a space", name)
+			}
+			if event, ok := strings.CutPrefix(name, "on:"); ok {
+				if !isEventName(event) {
+					return attrs, markupErrorf(attrStart, "%s isn't a valid event name, it has to be lowercase since HTML lowercases attributes", name)
+				}
+				if !isExpr {
+					return attrs, markupErrorf(attrStart, "%s needs a handler in {}, like %s={handler}", name, name)
+				}
+				if _, ok := attrs.events[event]; ok {
+					return attrs, markupErrorf(attrStart, "attribute %s is set more than once", name)
+				}
+				attrs.events[event] = value
+				continue
+			}
+			if directive, ok := strings.CutPrefix(name, "client:"); ok {
+				if !slices.Contains([]string{"none", "only", "visible"}, directive) {
+					return attrs, markupErrorf(attrStart, "%s isn't a client directive, it can be client:none, client:only or client:visible", name)
+				}
+				if value != "true" || isExpr {
+					return attrs, markupErrorf(attrStart, "%s doesn't take a value", name)
+				}
+				if attrs.client != "" {
+					return attrs, markupErrorf(attrStart, "%s can't be used with client:%s, a component only hydrates one way", name, attrs.client)
+				}
+				attrs.client = directive
+				continue
+			}
+			if let, ok := strings.CutPrefix(name, "let:"); ok {
+				if !reIdent.MatchString(let) || (value != "true" && !reIdent.MatchString(value)) {
+					return attrs, markupErrorf(attrStart, "%s has to bind a slot prop to a variable name", strings.TrimSpace(markup[attrStart:i]))
+				}
+				attrs.lets[let] = let
+				if value != "true" {
+					attrs.lets[let] = value
+				}
+				continue
+			}
+			if !reIdent.MatchString(name) {
+				return attrs, markupErrorf(attrStart, "attribute %s isn't a valid prop name", name)
+			}
+			if _, ok := attrs.props[name]; ok {
+				return attrs, markupErrorf(attrStart, "attribute %s is set more than once", name)
+			}
+			attrs.props[name] = value
 		}
 	}
-	return comp_props
+	return attrs, nil
 }
 
 func formatArray(value any) string {
@@ -1033,14 +4804,25 @@ func formatObject(value any) string {
 	var pairs []string
 	for _, key := range keyInterfaces {
 		value := val.MapIndex(reflect.ValueOf(key))
-		pairs = append(pairs, fmt.Sprintf("%v: %v", key, anyToString(value.Interface())))
+		pairs = append(pairs, fmt.Sprintf("%v: %v", formatKey(key), anyToString(value.Interface())))
 	}
 
 	return "{" + strings.Join(pairs, ", ") + "}"
 }
 
+// formatKey quotes object keys that aren't valid JS identifiers (e.g. "first-name")
+func formatKey(key any) string {
+	str := fmt.Sprintf("%v", key)
+	if regexp.MustCompile(`^[A-Za-z_$][\w$]*$`).MatchString(str) {
+		return str
+	}
+	return strconv.Quote(str)
+}
+
 func formatElement(value any) string {
 	switch v := value.(type) {
+	case nil:
+		return "null"
 	case string:
 		return strconv.Quote(v)
 	case int:
@@ -1051,6 +4833,34 @@ func formatElement(value any) string {
 		return strconv.FormatFloat(v, 'f', -1, 64)
 	case bool:
 		return strconv.FormatBool(v)
+	case promiseResult:
+		switch v.state {
+		case goja.PromiseStateFulfilled:
+			return "Promise.resolve(" + anyToString(v.value) + ")"
+		case goja.PromiseStateRejected:
+			return "Promise.reject(" + anyToString(v.value) + ")"
+		default:
+			return "new Promise(() => {})"
+		}
+	}
+	// Go props aren't limited to the types Goja exports, so fall back on the kind
+	val := reflect.ValueOf(value)
+	switch val.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(val.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(val.Uint(), 10)
+	case reflect.Float32:
+		return strconv.FormatFloat(val.Float(), 'f', -1, 32)
+	case reflect.String:
+		return strconv.Quote(val.String())
+	case reflect.Bool:
+		return strconv.FormatBool(val.Bool())
+	case reflect.Pointer, reflect.Interface:
+		if val.IsNil() {
+			return "null"
+		}
+		return anyToString(val.Elem().Interface())
 	default:
 		return "unknown type"
 	}
@@ -1070,7 +4880,25 @@ func anyToString(value any) string {
 
 func makeGetter(comp_data map[string]any, fence_logic string) (string, string) {
 	x_data_str := fmt.Sprintf("_fence: `%s`,", fence_logic)
+	for name := range comp_data {
+		x_data_str += name + ": undefined, "
+	}
+	params_str, args_str := getterArgs(comp_data, fence_logic)
+
+	i := 0
+	var x_init_str string
+	for name := range comp_data {
+		//x_data_str += fmt.Sprintf("get %s() {return (new Function('%s', `${this._fence}; return %s;`))(%s); },", name, params_str, name, args_str)
+		x_init_str += fmt.Sprintf("%s = new Function('%s', `${_fence}; return %s;`)(%s),", name, params_str, name, args_str)
+		x_init_str += fmt.Sprintf("$watch('Alpine.$data($el.parentElement)', () => %s = new Function('%s', `${_fence}; return %s;`)(%s)),", name, params_str, name, args_str)
+		i++
+	}
+	return "{" + x_data_str + "}", strings.TrimRight(x_init_str, ",")
+}
 
+// getterArgs returns the parameters the fence is run with on the client and the
+// arguments that fill them in from the x-data of the template using the component
+func getterArgs(comp_data map[string]any, fence_logic string) (string, string) {
 	params := make([]string, 0, len(comp_data))
 	args := make([]string, 0, len(comp_data))
 	for k, v := range comp_data {
@@ -1082,26 +4910,22 @@ func makeGetter(comp_data map[string]any, fence_logic string) (string, string) {
 
 		for prop_name, _ := range comp_data {
 			if strings.Contains(value_str, prop_name) {
-				// TODO: This string replacement is sloppy and could target partial variables or string values
-				value_str = strings.ReplaceAll(value_str, prop_name, "Alpine.$data($el.parentElement)."+prop_name)
+				// Only whole variables are replaced, not properties like obj.prop_name
+				// TODO: This string replacement is sloppy and could still target string values
+				reVar := regexp.MustCompile(`(^|[^\w$.])` + regexp.QuoteMeta(prop_name) + `\b`)
+				value_str = reVar.ReplaceAllString(value_str, "${1}Alpine.$$data($$el.parentElement)."+strings.ReplaceAll(prop_name, "$", "$$"))
 			}
 
 		}
 		args = append(args, value_str)
 	}
-	x_data_str += strings.Join(append(params, ""), ": undefined, ")
-	params_str := strings.Join(params, ", ")
-	args_str := strings.Join(args, ", ")
-
-	i := 0
-	var x_init_str string
-	for name := range comp_data {
-		//x_data_str += fmt.Sprintf("get %s() {return (new Function('%s', `${this._fence}; return %s;`))(%s); },", name, params_str, name, args_str)
-		x_init_str += fmt.Sprintf("%s = new Function('%s', `${_fence}; return %s;`)(%s),", name, params_str, name, args_str)
-		x_init_str += fmt.Sprintf("$watch('Alpine.$data($el.parentElement)', () => %s = new Function('%s', `${_fence}; return %s;`)(%s)),", name, params_str, name, args_str)
-		i++
+	// The fence reads the context the server rendered with from the closest _context above it,
+	// setting it again on the client doesn't change what's already been rendered
+	if regexp.MustCompile(`\b[gs]etContext\s*\(`).MatchString(fence_logic) {
+		params = append(params, "getContext", "setContext")
+		args = append(args, "key => (Alpine.$data($el)._context || {})[key]", "(key, value) => value")
 	}
-	return "{" + x_data_str + "}", strings.TrimRight(x_init_str, ",")
+	return strings.Join(params, ", "), strings.Join(args, ", ")
 }
 
 func isBoolAndTrue(value any) bool {
@@ -1136,7 +4960,10 @@ func copyFile(sourcePath, destPath string) {
 func main() {
 	// Render the template with data
 	props := map[string]any{"name": "Ja", "age": 2, "animals": []string{"cat", "dog", "pig"}}
-	markup, script, style, _ := Render("views/home.html", props)
+	markup, script, style, _, err := Render("views/home.html", props, Config{})
+	if err != nil {
+		log.Fatal(err)
+	}
 	os.MkdirAll("./public", os.ModePerm)
 	os.WriteFile("./public/script.js", []byte(script), fs.ModePerm)
 	os.WriteFile("./public/style.css", []byte(style), fs.ModePerm)
@@ -1145,7 +4972,7 @@ func main() {
 		// Test render speed
 		start := time.Now()
 		for i := 1; i <= 500; i++ {
-			markup, script, style, _ := Render("views/home.html", props)
+			markup, script, style, _, _ := Render("views/home.html", props, Config{})
 			os.WriteFile(fmt.Sprintf("./public/script%d.js", i), []byte(script), 0644)
 			os.WriteFile(fmt.Sprintf("./public/style%d.css", i), []byte(style), 0644)
 			os.WriteFile(fmt.Sprintf("./public/index%d.html", i), []byte(markup), 0644)
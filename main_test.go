@@ -0,0 +1,688 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/dop251/goja"
+	"golang.org/x/net/html"
+)
+
+var update = flag.Bool("update", false, "write the rendered output to the .golden files instead of comparing")
+
+var (
+	reClass       = regexp.MustCompile(` class="([^"]*)"`)
+	reScopedClass = regexp.MustCompile(`\s*\bplenti-[A-Za-z0-9]{6}\b`)
+	reGetters     = regexp.MustCompile(` x-data="\{[^"]*_fence:[^"]*"| x-init="[^"]*"`)
+)
+
+// normalizeBody returns the <body> of rendered markup without what changes between renders:
+// scoped classes are random, and component getters list props in map order
+func normalizeBody(markup string) string {
+	markup = reClass.ReplaceAllStringFunc(markup, func(attr string) string {
+		classes := strings.TrimSpace(reScopedClass.ReplaceAllString(reClass.FindStringSubmatch(attr)[1], ""))
+		if classes == "" {
+			return ""
+		}
+		return ` class="` + classes + `"`
+	})
+	_, body, _ := strings.Cut(markup, "<body>")
+	body, _, _ = strings.Cut(body, "</body>")
+	return strings.TrimSpace(reGetters.ReplaceAllString(body, ""))
+}
+
+// checkGolden renders the template at path and compares its <body> with the .golden file next to it
+func checkGolden(t *testing.T, path string, props map[string]any, config Config) {
+	t.Helper()
+	markup, _, _, _, err := Render(path, props, config)
+	if err != nil {
+		t.Fatalf("rendering %s failed: %v", path, err)
+	}
+	compareGolden(t, path, normalizeBody(markup))
+}
+
+// checkDiagnostic renders the template at path and compares the error it fails with with the .golden file next to it
+func checkDiagnostic(t *testing.T, path string, props map[string]any, config Config) {
+	t.Helper()
+	markup, _, _, _, err := Render(path, props, config)
+	if err == nil {
+		t.Fatalf("rendering %s should fail, got:\n%s", path, normalizeBody(markup))
+	}
+	compareGolden(t, path, err.Error())
+}
+
+// compareGolden compares got with the .golden file for the template at path, or updates it with -update
+func compareGolden(t *testing.T, path string, got string) {
+	t.Helper()
+	got += "\n"
+	golden := strings.TrimSuffix(path, filepath.Ext(path)) + ".golden"
+	if *update {
+		if err := os.WriteFile(golden, []byte(got), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("%s doesn't match %s, got:\n%s", path, golden, got)
+	}
+}
+
+// checkParseError checks that buildControlTree fails on markup with message at index
+func checkParseError(t *testing.T, markup string, index int, message string) {
+	t.Helper()
+	_, err := buildControlTree(markup, false)
+	var mErr *markupError
+	if !errors.As(err, &mErr) || mErr.index != index || mErr.message != message {
+		t.Errorf("buildControlTree(%q) error = %v, want %q at index %d", markup, err, message, index)
+	}
+}
+
+func TestParseForHeader(t *testing.T) {
+	tests := []struct {
+		header string
+		want   control
+		err    string
+	}{
+		{header: "let item of items", want: control{forVar: "item", forCollection: "items"}},
+		{header: "const item, i of items key item.id", want: control{forVar: "item", forIndex: "i", forCollection: "items", forKey: "item.id"}},
+		{header: "let [i, item] of items.entries()", want: control{forVar: "[i, item]", forCollection: "items.entries()"}},
+		{header: "let {title, done}, i of todos key title", want: control{forVar: "{title, done}", forIndex: "i", forCollection: "todos", forKey: "title"}},
+		{header: "let item of items.filter(i => i.key !== 'key ') key item", want: control{forVar: "item", forCollection: "items.filter(i => i.key !== 'key ')", forKey: "item"}},
+		{header: "let name in person", want: control{forVar: "name", forIn: true, forCollection: "person"}},
+		{header: "item of items", err: "missing let, var or const declaration"},
+		{header: "let [k v] of pairs", err: `has invalid destructuring pattern "[k v]"`},
+		{header: "let item items", err: "missing iterator / collection"},
+	}
+	for _, test := range tests {
+		got, err := parseForHeader(test.header)
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("parseForHeader(%q) error = %v, want %q", test.header, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseForHeader(%q) unexpected error: %v", test.header, err)
+			continue
+		}
+		test.want.isForLoop = true
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseForHeader(%q) = %+v, want %+v", test.header, got, test.want)
+		}
+	}
+}
+
+func TestForLoop(t *testing.T) {
+	checkGolden(t, "testdata/for/index.html", map[string]any{}, Config{})
+}
+
+func TestForKeys(t *testing.T) {
+	todos := []map[string]any{{"id": 1, "title": "Write"}, {"id": 2, "title": "Test"}}
+	checkGolden(t, "testdata/for/keyed.html", map[string]any{"todos": todos}, Config{})
+	checkDiagnostic(t, "testdata/for/keyed_duplicate.html", map[string]any{}, Config{})
+	checkDiagnostic(t, "testdata/for/keyed_component.html", map[string]any{}, Config{})
+
+	// Reordering the todos reorders the items rendered at build time, while the browser gets
+	// the same x-for, which clears those out and moves its own items by key
+	reTemplate := regexp.MustCompile(`<template x-for="\(todo, i\) in .*?</template>`)
+	var templates []string
+	for _, order := range [][]map[string]any{todos, {todos[1], todos[0]}} {
+		markup, _, _, _, err := Render("testdata/for/keyed.html", map[string]any{"todos": order}, Config{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := normalizeBody(markup)
+		first, second := strings.Index(body, order[0]["title"].(string)), strings.Index(body, order[1]["title"].(string))
+		if first == -1 || second == -1 || first > second {
+			t.Errorf("items aren't rendered in the order %v:\n%s", order, body)
+		}
+		template := reTemplate.FindString(body)
+		if !strings.Contains(template, `:key="todo.id"`) || !strings.Contains(markup, `x-init="`+html.EscapeString(removeForItems)+`"`) {
+			t.Errorf("loop is missing its keyed x-for:\n%s", markup)
+		}
+		templates = append(templates, template)
+	}
+	if templates[0] != templates[1] {
+		t.Errorf("the x-for changed with the order of the items:\n%s\n%s", templates[0], templates[1])
+	}
+}
+
+func TestForCollections(t *testing.T) {
+	checkGolden(t, "testdata/for/collections.html", map[string]any{
+		"names":  []string{"Ann", "Bo"},
+		"people": []map[string]any{{"name": "Cy"}},
+	}, Config{})
+}
+
+func TestForLoopNotIterable(t *testing.T) {
+	for _, collection := range []string{"null", "42", "undefined"} {
+		_, err := evalForLoop(control{isForLoop: true, forVar: "item", forCollection: collection}, map[string]any{})
+		if err == nil || !strings.Contains(err.Error(), "is not iterable") {
+			t.Errorf("looping over %s gave error %v, want it to say it is not iterable", collection, err)
+		}
+	}
+	_, err := evalForLoop(control{isForLoop: true, forVar: "key", forIn: true, forCollection: "'abc'"}, map[string]any{})
+	if err == nil || !strings.Contains(err.Error(), "can't loop over the keys of abc") {
+		t.Errorf("looping over the keys of a string gave error %v", err)
+	}
+}
+
+func TestForElse(t *testing.T) {
+	checkGolden(t, "testdata/for/else.html", map[string]any{}, Config{})
+	checkDiagnostic(t, "testdata/for/else_component.html", map[string]any{}, Config{})
+
+	checkParseError(t, "<p>{else}</p>", 3, "{else} missing opening {if} or {for}")
+}
+
+func TestSwitch(t *testing.T) {
+	checkGolden(t, "testdata/switch/index.html", map[string]any{}, Config{})
+}
+
+func TestSwitchParseErrors(t *testing.T) {
+	checkParseError(t, "{switch x}{default}a{case 1}b{/switch}", 20, "{case} comes after {default}, which must be the last branch of a {switch}")
+	checkParseError(t, "{switch x}{default}a{default}b{/switch}", 20, "duplicate {default}, a {switch} can only have one")
+	checkParseError(t, "{case 1}a", 0, "{case} missing opening {switch}")
+	checkParseError(t, "{switch x}stray{case 1}a{/switch}", 10, "content must be inside a {case} or {default} branch")
+	checkParseError(t, "a{/switch}", 1, "closing {/switch} without opening {switch}")
+}
+
+func TestAwait(t *testing.T) {
+	checkGolden(t, "testdata/await/index.html", map[string]any{}, Config{})
+
+	checkParseError(t, "<p>{then value}</p>", 3, "{then} or {catch} missing opening {await}")
+}
+
+func TestBindings(t *testing.T) {
+	checkGolden(t, "testdata/bindings/index.html", map[string]any{}, Config{})
+	checkParseError(t, "{const x}", 0, `{const} binding missing "= value"`)
+	checkParseError(t, "{let 1x = 2}", 0, `{let} binding has invalid name "1x"`)
+	checkParseError(t, "{const x = 1", 0, `{const} binding missing closing "}"`)
+	checkDiagnostic(t, "testdata/bindings/outside_block.html", map[string]any{}, Config{})
+}
+
+func TestEscaping(t *testing.T) {
+	checkGolden(t, "testdata/escaping/index.html", map[string]any{
+		"bio":  `<script>alert("hi")</script>`,
+		"site": "javascript:alert(1)",
+		"name": `Ann & "Bo" {x}`,
+	}, Config{})
+	// Handlers and scripts get JSON, or more of the string when the value is inside one
+	checkGolden(t, "testdata/escaping/script.html", map[string]any{"name": `Ann "Bo" 'Cy' ${x} </script><script>alert(1)`}, Config{})
+}
+
+func TestIsHandlerAttr(t *testing.T) {
+	for key, want := range map[string]bool{
+		"onclick":  true,
+		"onClick":  true,
+		"onsubmit": true,
+		"onion":    false,
+		"one":      false,
+		"on":       false,
+		"title":    false,
+	} {
+		if got := isHandlerAttr(key); got != want {
+			t.Errorf("isHandlerAttr(%q) = %v, want %v", key, got, want)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	checkGolden(t, "testdata/comments/index.html", map[string]any{}, Config{})
+	if _, _, style, _, _ := Render("testdata/comments/index.html", map[string]any{}, Config{}); strings.Contains(style, "--") {
+		t.Errorf("comment left in the style:\n%s", style)
+	}
+
+	checkParseError(t, "<p>{!-- never closed</p>", 3, `{!-- comment missing closing "--}"`)
+}
+
+func TestTrimMarkers(t *testing.T) {
+	checkGolden(t, "testdata/trim/markers.html", map[string]any{}, Config{})
+	checkGolden(t, "testdata/trim/use_trim.html", map[string]any{}, Config{})
+}
+
+func TestTrimWhitespaceConfig(t *testing.T) {
+	checkGolden(t, "testdata/trim/config.html", map[string]any{}, Config{TrimWhitespace: true})
+}
+
+func TestDiagnostics(t *testing.T) {
+	for _, name := range []string{"markup", "fence", "parse", "chain", "missing"} {
+		t.Run(name, func(t *testing.T) {
+			checkDiagnostic(t, "testdata/diagnostics/"+name+".html", map[string]any{}, Config{})
+		})
+	}
+}
+
+func TestDefaultSlot(t *testing.T) {
+	checkGolden(t, "testdata/slots/index.html", map[string]any{}, Config{})
+
+	// The slot content belongs to the page, so the page's style applies to it
+	markup, _, style, _, err := Render("testdata/slots/index.html", map[string]any{}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	class := regexp.MustCompile(`<p class="(plenti-\w+)"`).FindStringSubmatch(markup)
+	if class == nil || !strings.Contains(style, "p."+class[1]+"{color:red;}") {
+		t.Errorf("the page's style doesn't apply to the slot content:\n%s\n%s", markup, style)
+	}
+
+	checkParseError(t, "<Card><p>Hi</p></Other>", 15, "closing </Other> without opening <Other>")
+}
+
+func TestNamedSlots(t *testing.T) {
+	checkGolden(t, "testdata/named_slots/index.html", map[string]any{}, Config{})
+	checkGolden(t, "testdata/named_slots/values.html", map[string]any{}, Config{})
+
+	checkParseError(t, "<Card>a</slot></Card>", 7, "closing </slot> without opening <slot>")
+}
+
+func TestBuildSlots(t *testing.T) {
+	tree, err := buildControlTree(`{if true}<Layout><h1 slot="header">A</h1><Card>B</Card></Layout>{/if}`, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := buildSlots(tree); err != nil {
+		t.Fatal(err)
+	}
+	layout := tree[0].children[0]
+	if layout.slots["header"] == nil || layout.slots[""] == nil {
+		t.Fatalf("<Layout> slots = %v, want a header and a default slot", layout.slots)
+	}
+	// Components inside slot content get their slots built too
+	for _, ctrl := range layout.slots[""].tree {
+		if ctrl.isComp && ctrl.compName == "Card" {
+			if ctrl.slots[""] == nil {
+				t.Error("<Card> inside the default slot has no slots built")
+			}
+			return
+		}
+	}
+	t.Error("<Card> is missing from the default slot")
+}
+
+func TestSpread(t *testing.T) {
+	checkGolden(t, "testdata/spread/index.html", map[string]any{}, Config{})
+	checkDiagnostic(t, "testdata/spread/not_object.html", map[string]any{}, Config{})
+}
+
+func TestParseCompAttrs(t *testing.T) {
+	tag := ` data={{a: 1}} fn={() => { return x }} label={"}"} name="Bill"
+	title='Hi {name}' disabled {age} {...rest} let:item on:change={value => age = value}`
+	attrs, err := parseCompAttrs(tag, 0, len(tag))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := compAttrs{
+		props: map[string]any{
+			"data":     "{a: 1}",
+			"fn":       "() => { return x }",
+			"label":    `"}"`,
+			"name":     `"Bill"`,
+			"title":    "`Hi ${name}`",
+			"disabled": "true",
+			"age":      "age",
+		},
+		spreads: []string{"rest"},
+		lets:    map[string]string{"item": "item"},
+		events:  map[string]string{"change": "value => age = value"},
+	}
+	if !reflect.DeepEqual(attrs, want) {
+		t.Errorf("parseCompAttrs(%q) = %#v, want %#v", tag, attrs, want)
+	}
+
+	tests := []struct {
+		tag   string
+		index int
+		err   string
+	}{
+		{` name=Bill`, 1, "attribute name value has to be quoted or wrapped in {}"},
+		{` a={1} a={2}`, 7, "attribute a is set more than once"},
+		{` {a.b}`, 1, "shorthand attribute {a.b} has to be a variable name"},
+		{` a={}`, 1, "attribute a has an empty {} value"},
+		{` a="x`, 1, `attribute a missing closing "`},
+		{` a={1}b={2}`, 6, "attribute a has to be followed by a space"},
+		{` on:={f}`, 1, "on: isn't a valid event name, it has to be lowercase since HTML lowercases attributes"},
+		{` on:onChange={f}`, 1, "on:onChange isn't a valid event name, it has to be lowercase since HTML lowercases attributes"},
+		{` on:change="f"`, 1, "on:change needs a handler in {}, like on:change={handler}"},
+	}
+	for _, test := range tests {
+		_, err := parseCompAttrs(test.tag, 0, len(test.tag))
+		var mErr *markupError
+		if !errors.As(err, &mErr) || mErr.index != test.index || mErr.message != test.err {
+			t.Errorf("parseCompAttrs(%q) error = %v, want %q at index %d", test.tag, err, test.err, test.index)
+		}
+	}
+}
+
+func TestComponentAttributes(t *testing.T) {
+	checkGolden(t, "testdata/attributes/index.html", map[string]any{}, Config{})
+}
+
+func TestPascalCase(t *testing.T) {
+	for name, want := range map[string]string{
+		"age_button":  "AgeButton",
+		"age-button":  "AgeButton",
+		"card":        "Card",
+		"nav.item_2":  "NavItem2",
+		"_private__x": "PrivateX",
+	} {
+		if got := pascalCase(name); got != want {
+			t.Errorf("pascalCase(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestComponentDiscovery(t *testing.T) {
+	checkGolden(t, "testdata/discovery/index.html", map[string]any{}, Config{
+		ComponentDirs: []string{"testdata/discovery/components"},
+	})
+	checkDiagnostic(t, "testdata/discovery/ambiguous.html", map[string]any{}, Config{
+		ComponentDirs: []string{"testdata/discovery/components", "testdata/discovery/widgets"},
+	})
+}
+
+func TestRecursion(t *testing.T) {
+	checkGolden(t, "testdata/recursion/index.html", map[string]any{}, Config{})
+	checkDiagnostic(t, "testdata/recursion/circular.html", map[string]any{}, Config{})
+	checkDiagnostic(t, "testdata/recursion/too_deep.html", map[string]any{}, Config{MaxRecursion: 3})
+	// Content passed to a <slot> is rendered by the component, unless it doesn't have that slot
+	checkDiagnostic(t, "testdata/recursion/slotted.html", map[string]any{}, Config{})
+	checkGolden(t, "testdata/recursion/unused_slot.html", map[string]any{}, Config{})
+}
+
+func TestTemplateCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "page.html")
+	for _, step := range []struct {
+		template string
+		want     string // The <body>, or part of the error when it starts with "error: "
+	}{
+		{`<p>first</p>`, `<p>first</p>`},
+		{`<p>{if true}second</p>`, "error: block is never closed"},
+		{`<p>{if true}the third{/if}</p>`, `<p>the third</p>`},
+	} {
+		if err := os.WriteFile(path, []byte(step.template), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		markup, _, _, _, err := Render(path, map[string]any{}, Config{})
+		if wantErr, ok := strings.CutPrefix(step.want, "error: "); ok {
+			if err == nil || !strings.Contains(err.Error(), wantErr) {
+				t.Fatalf("%s: error = %v, want %q", step.template, err, wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", step.template, err)
+		}
+		if got := normalizeBody(markup); got != step.want {
+			t.Errorf("%s: got %s, want %s", step.template, got, step.want)
+		}
+	}
+
+	first, err := compileTemplate(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if second, _ := compileTemplate(path, false); second != first {
+		t.Error("compiling an unchanged template didn't reuse the cached one")
+	}
+
+	// An edit that keeps the size and the modification time still has to be picked up
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(`<p>{if true}the fifth{/if}</p>`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+		t.Fatal(err)
+	}
+	markup, _, _, _, err := Render(path, map[string]any{}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := normalizeBody(markup); got != `<p>the fifth</p>` {
+		t.Errorf("same size edit: got %s, want <p>the fifth</p>", got)
+	}
+}
+
+func TestTemplateCacheEviction(t *testing.T) {
+	defer func(max int) { maxCachedTemplates = max }(maxCachedTemplates)
+	maxCachedTemplates = 2
+	templateCache.Lock()
+	clear(templateCache.templates)
+	templateCache.Unlock()
+
+	dir := t.TempDir()
+	paths := make([]string, 3)
+	for i := range paths {
+		paths[i] = filepath.Join(dir, "page"+strconv.Itoa(i)+".html")
+		if err := os.WriteFile(paths[i], []byte(`<p>page</p>`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first, err := compileTemplate(paths[0], false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	compileTemplate(paths[1], false)
+	compileTemplate(paths[0], false) // The second page is now the least recently used
+	compileTemplate(paths[2], false)
+
+	templateCache.Lock()
+	size := len(templateCache.templates)
+	_, kept := templateCache.templates[templateKey{path: paths[1]}]
+	templateCache.Unlock()
+	if size != 2 {
+		t.Errorf("cache holds %d templates, want 2", size)
+	}
+	if kept {
+		t.Error("the least recently used template wasn't evicted")
+	}
+	if again, _ := compileTemplate(paths[0], false); again != first {
+		t.Error("a recently used template was evicted")
+	}
+}
+
+func TestDynamicComponents(t *testing.T) {
+	checkGolden(t, "testdata/dynamic/index.html", map[string]any{"kind": "warning"}, Config{DynamicRoot: "testdata/dynamic"})
+}
+
+func TestResolveDynamicPath(t *testing.T) {
+	root := t.TempDir()
+	if err := os.Symlink(os.TempDir(), filepath.Join(root, "link")); err != nil {
+		t.Fatal(err)
+	}
+	config := Config{DynamicRoot: root, DynamicAllow: []string{"cards/*.html"}}
+
+	tests := []struct {
+		path string
+		want string // The resolved path, or the error
+	}{
+		{"cards/note.html", filepath.Join(root, "cards/note.html")},
+		{"/cards/../cards/note.html", filepath.Join(root, "cards/note.html")},
+		{"../../etc/passwd", `dynamic component "../../etc/passwd" is outside of ` + root},
+		{"cards/../../secret.html", `dynamic component "cards/../../secret.html" is outside of ` + root},
+		{"link/cards/x.html", `dynamic component "link/cards/x.html" isn't allowed by config.DynamicAllow`},
+		{"private/secret.html", `dynamic component "private/secret.html" isn't allowed by config.DynamicAllow`},
+	}
+	for _, test := range tests {
+		got, err := resolveDynamicPath(test.path, config)
+		if err != nil {
+			got = err.Error()
+		}
+		if got != test.want {
+			t.Errorf("resolveDynamicPath(%q) = %q, want %q", test.path, got, test.want)
+		}
+	}
+
+	// A symlink that leaves the root is caught once it resolves to a file
+	config.DynamicAllow = nil
+	target, err := os.CreateTemp("", "secret*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	target.Close()
+	t.Cleanup(func() { os.Remove(target.Name()) })
+	linked := "link/" + filepath.Base(target.Name())
+	if _, err := resolveDynamicPath(linked, config); err == nil || !strings.Contains(err.Error(), "links outside of") {
+		t.Errorf("resolveDynamicPath(%q) error = %v, want it to link outside of the root", linked, err)
+	}
+}
+
+func TestLayouts(t *testing.T) {
+	checkGolden(t, "testdata/layouts/index.html", map[string]any{"title": "Docs"}, Config{})
+	markup, _, style, _, err := Render("testdata/layouts/index.html", map[string]any{"title": "Docs"}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !regexp.MustCompile(`<title[^>]*>Docs</title>`).MatchString(markup) {
+		t.Errorf("the layout's <head> is missing the title:\n%s", markup)
+	}
+	// The page's and the layout's styles both end up in the page
+	if !strings.Contains(style, "{padding:1rem;}") || !strings.Contains(style, "{color:red;}") {
+		t.Errorf("style is missing the layout's or the page's rules:\n%s", style)
+	}
+	checkDiagnostic(t, "testdata/layouts/stray.html", map[string]any{}, Config{})
+	checkDiagnostic(t, "testdata/layouts/loop_a.html", map[string]any{}, Config{})
+
+	checkParseError(t, "{block a b}{/block}", 0, "{block a b} name can only have letters, numbers, _ and -")
+}
+
+func TestPropTypeCheck(t *testing.T) {
+	tests := []struct {
+		typ   string
+		value any
+		err   string
+	}{
+		{"number", 3, ""},
+		{"number", 2.5, ""},
+		{"number", "3", `age should be number but got string "3"`},
+		{`"a" | "b"`, "b", ""},
+		{`"a" | "b"`, "c", `age should be "a" | "b" but got string "c"`},
+		{"string[]", []string{"a"}, ""},
+		{"string[]", []any{"a", 1}, "age[1] should be string but got number 1"},
+		{"{name: string; age?: number}", map[string]any{"name": "Ann"}, ""},
+		{"{name: string; age?: number}", map[string]any{"age": 1}, "age should be {name: string; age?: number} but is missing name"},
+		{"boolean | null", nil, ""},
+		{"any", struct{}{}, ""},
+	}
+	for _, test := range tests {
+		typ, err := parsePropType(test.typ)
+		if err != nil {
+			t.Errorf("parsePropType(%q) unexpected error: %v", test.typ, err)
+			continue
+		}
+		err = typ.check(test.value, "age")
+		if (err == nil && test.err != "") || (err != nil && err.Error() != test.err) {
+			t.Errorf("%s check of %#v = %v, want %q", test.typ, test.value, err, test.err)
+		}
+	}
+
+	for src, want := range map[string]string{
+		"Date":   "unknown type Date",
+		"{name}": `field "name" in {name} is missing a type`,
+		"":       "the type is empty",
+	} {
+		if _, err := parsePropType(src); err == nil || err.Error() != want {
+			t.Errorf("parsePropType(%q) error = %v, want %q", src, err, want)
+		}
+	}
+}
+
+func TestTypedProps(t *testing.T) {
+	checkGolden(t, "testdata/typed_props/index.html", map[string]any{"count": 3}, Config{})
+	checkDiagnostic(t, "testdata/typed_props/wrong_prop.html", map[string]any{}, Config{})
+
+	_, _, _, _, err := Render("testdata/typed_props/index.html", map[string]any{"count": "3"}, Config{})
+	if err == nil || !strings.Contains(err.Error(), `prop count should be number but got string "3"`) {
+		t.Errorf("passing a string for a number prop gave error %v", err)
+	}
+}
+
+func TestRequiredProps(t *testing.T) {
+	checkGolden(t, "testdata/required_props/index.html", map[string]any{}, Config{})
+	// Passing undefined doesn't count as passing the prop
+	checkDiagnostic(t, "testdata/required_props/missing.html", map[string]any{}, Config{})
+	checkDiagnostic(t, "testdata/required_props/default.html", map[string]any{}, Config{})
+
+	_, _, _, _, err := Render("testdata/required_props/age.html", map[string]any{"age": 3}, Config{})
+	if err == nil || !strings.Contains(err.Error(), "missing required prop name") {
+		t.Errorf("rendering without a required prop gave error %v", err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	checkGolden(t, "testdata/events/index.html", map[string]any{}, Config{})
+	checkDiagnostic(t, "testdata/events/undeclared.html", map[string]any{}, Config{})
+	checkDiagnostic(t, "testdata/events/uppercase.html", map[string]any{}, Config{})
+}
+
+func TestEventHandlerStrict(t *testing.T) {
+	// The handler has to compile as strict mode code, which is what module and CSP builds of Alpine run
+	for _, handler := range []string{
+		`event => total = event.detail`,
+		`event => label = "it's " + event.detail`,
+		`console.log('a \\ b')`,
+	} {
+		src := "'use strict'; (function ($event, $el, Alpine) { return " + makeEventHandler(handler) + " })"
+		if _, err := goja.Compile("handler", src, true); err != nil {
+			t.Errorf("%s: %v", handler, err)
+		}
+	}
+}
+
+func TestContext(t *testing.T) {
+	checkGolden(t, "testdata/context/index.html", map[string]any{}, Config{})
+
+	// The client reads the values from the _context of the closest element that has one
+	markup, _, _, _, err := Render("testdata/context/index.html", map[string]any{}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{"_context: {theme: &#39;dark&#39;}", "_context: {theme: &#39;light&#39;}"} {
+		if !strings.Contains(markup, want) {
+			t.Errorf("markup is missing %s:\n%s", want, markup)
+		}
+	}
+}
+
+func TestIslands(t *testing.T) {
+	checkGolden(t, "testdata/islands/index.html", map[string]any{}, Config{})
+	checkDiagnostic(t, "testdata/islands/none_events.html", map[string]any{}, Config{})
+	checkDiagnostic(t, "testdata/islands/only_nested.html", map[string]any{}, Config{})
+	checkGolden(t, "testdata/islands/top_level.html", map[string]any{}, Config{})
+
+	// A client:only component at the top of a page has to stay in the <body>, ahead of what follows it
+	markup, _, _, _, err := Render("testdata/islands/top_level.html", map[string]any{}, Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	head, _, _ := strings.Cut(markup, "</head>")
+	if strings.Contains(head, "<template") {
+		t.Errorf("the client:only template ended up in <head>:\n%s", markup)
+	}
+	body := normalizeBody(markup)
+	if !strings.HasPrefix(body, `<div style="display: contents"><template x-if="true"><div style="display: contents"`) || !strings.HasSuffix(body, "</template></div>\n<p>after</p>") {
+		t.Errorf("the client:only template isn't at the top of <body>:\n%s", body)
+	}
+
+	checkParseError(t, `<Card client:server />`, 6, "client:server isn't a client directive, it can be client:none, client:only or client:visible")
+	checkParseError(t, `<Card client:none="yes" />`, 6, "client:none doesn't take a value")
+	checkParseError(t, `<Card client:none client:only />`, 18, "client:only can't be used with client:none, a component only hydrates one way")
+}
+
+func TestSelf(t *testing.T) {
+	checkGolden(t, "testdata/self/index.html", map[string]any{}, Config{})
+	checkDiagnostic(t, "testdata/self/unguarded.html", map[string]any{}, Config{})
+}